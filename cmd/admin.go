@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/netlify/elastinats/conf"
+	"github.com/netlify/elastinats/stats"
+)
+
+// startAdmin serves the admin endpoints in the background
+func startAdmin(config *conf.AdminConfig, r *runner, log *logrus.Entry) {
+	log = log.WithField("listen", config.Listen)
+	handler := r.adminHandler(config.Token)
+
+	go func() {
+		log.Info("Starting admin listener")
+		if err := http.ListenAndServe(config.Listen, handler); err != nil {
+			log.WithError(err).Fatal("Admin listener failed")
+		}
+	}()
+}
+
+// adminHandler routes the admin endpoints. The config and the admin API need
+// the token, the metrics and health checks don't.
+func (r *runner) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", authorized(token, http.MethodGet, r.serveConfig))
+	mux.HandleFunc("/metrics", r.serveMetrics)
+	mux.HandleFunc("/healthz", r.serveHealth)
+	mux.HandleFunc("/readyz", r.serveReady)
+	r.handleControl(mux, token)
+	return mux
+}
+
+// serveConfig responds with the running config like 'config print', the format
+// can be picked with ?format=yaml
+func (r *runner) serveConfig(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	config := r.config
+	r.mu.Unlock()
+
+	format := req.URL.Query().Get("format")
+	out, err := describeConfig(config, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if format == "yaml" || format == "yml" {
+		w.Header().Set("Content-Type", "application/yaml")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Write(out)
+}
+
+// serveMetrics responds with the stats of the subscriptions and endpoints in
+// the Prometheus text format
+func (r *runner) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	e := stats.NewExposition()
+	r.mu.Lock()
+	for _, key := range sortedKeys(r.subscriptions) {
+		s := r.subscriptions[key]
+		pair := s.settings()
+
+		labels := stats.Labels{
+			"subject":      pair.Subject,
+			"group":        pair.Group,
+			"connection":   pair.ConnectionName(),
+			"subscription": s.seriesID,
+		}
+		if endpoint, err := r.config.Endpoint(pair); err == nil {
+			labels["index"] = endpoint.Index
+		}
+		s.stats.Collect(e, labels, s)
+	}
+	endpoints := make([]string, 0, len(r.consumers.byEndpoint))
+	for key := range r.consumers.byEndpoint {
+		endpoints = append(endpoints, key)
+	}
+	sort.Strings(endpoints)
+	for _, key := range endpoints {
+		b := r.consumers.byEndpoint[key]
+		b.stats.Collect(e, stats.Labels{
+			"index":    b.endpoint.Index,
+			"hosts":    strings.Join(b.endpoint.Hosts, ","),
+			"endpoint": b.seriesID,
+		})
+	}
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	e.WriteTo(w)
+}
+
+// seriesCount numbers the subscriptions and endpoints for their metrics. The
+// keys they're found by have the credentials, so they can't be used for it.
+var seriesCount int64
+
+// nextSeriesID is the ID of a new subscription or endpoint, it is kept for as
+// long as a reload doesn't replace them
+func nextSeriesID() string {
+	return strconv.FormatInt(atomic.AddInt64(&seriesCount, 1), 10)
+}
+
+func sortedKeys(subscriptions map[string]*subscription) []string {
+	keys := make([]string, 0, len(subscriptions))
+	for key := range subscriptions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/elastinats/conf"
+)
+
+func adminRequest(handler http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestConfigNeedsToken(t *testing.T) {
+	r := newRunner(testLog)
+	r.config = &conf.Config{ElasticConf: &conf.ElasticConfig{Index: "logs", Hosts: []string{"es"}, User: "elastic", Password: "secret"}}
+
+	assert.Equal(t, http.StatusForbidden, adminRequest(r.adminHandler(""), http.MethodGet, "/config", "").Code)
+
+	handler := r.adminHandler("admin")
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(handler, http.MethodGet, "/config", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(handler, http.MethodGet, "/config", "wrong").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, adminRequest(handler, http.MethodPost, "/config", "admin").Code)
+
+	rec := adminRequest(handler, http.MethodGet, "/config", "admin")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"index": "logs"`)
+	assert.NotContains(t, rec.Body.String(), "secret")
+
+	// the health checks stay open
+	assert.Equal(t, http.StatusOK, adminRequest(handler, http.MethodGet, "/healthz", "").Code)
+}
+
+func TestMetricsSeriesAreDistinct(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	es := startTestElastic()
+	defer es.Close()
+
+	// the same subject twice, and an endpoint that only differs in its batch size
+	r := newRunner(testLog)
+	assert.Nil(t, r.apply(testConfig(server, es,
+		conf.SubjectAndGroup{Subject: "logs"},
+		conf.SubjectAndGroup{Subject: "logs"},
+		conf.SubjectAndGroup{Subject: "audit", Endpoint: &conf.ElasticConfig{BatchSize: 100}},
+	)))
+
+	rec := adminRequest(r.adminHandler(""), http.MethodGet, "/metrics", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	series := map[string]bool{}
+	endpoints := 0
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := line[:strings.LastIndex(line, " ")]
+		assert.False(t, series[name], "duplicate series %s", name)
+		series[name] = true
+		if strings.HasPrefix(name, "elastinats_endpoint_batches_sent_total{") {
+			endpoints++
+		}
+	}
+	assert.Equal(t, 2, endpoints)
+}
+
+func TestPauseDoesNotBlockMetrics(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+
+	s, subs, release, handled := blockedSubscription(t, server, &conf.SubjectAndGroup{Subject: "logs"})
+	defer s.drain(subs)
+	r := newRunner(testLog)
+	r.config = &conf.Config{}
+	r.subs = subs
+	r.subscriptions["logs"] = s
+
+	// the message being handled keeps the pause waiting
+	publish(t, server, "logs", "line")
+	eventually(t, "the message to be handled", func() bool {
+		delivered, _ := s.Delivered()
+		return delivered == 1
+	})
+
+	handler := r.adminHandler("admin")
+	paused := make(chan int)
+	go func() {
+		paused <- adminRequest(handler, http.MethodPost, "/subscriptions/pause?subject=logs", "admin").Code
+	}()
+	eventually(t, "the pause to start", func() bool { return s.status() == statusHeld })
+
+	done := make(chan bool)
+	go func() {
+		adminRequest(handler, http.MethodGet, "/metrics", "")
+		adminRequest(handler, http.MethodGet, "/readyz", "")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		close(release)
+		<-paused
+		assert.FailNow(t, "the metrics waited for the pause")
+	}
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-paused)
+	assert.EqualValues(t, 1, atomic.LoadInt64(handled))
+}
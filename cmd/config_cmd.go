@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/netlify/elastinats/conf"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "inspect the configuration",
+}
+
+var configPrintCmd = &cobra.Command{
+	Run:   printConfig,
+	Use:   "print",
+	Short: "print the effective configuration",
+	Long:  "print the configuration after the file, environment and flags are merged and the defaults are applied, along with where each value came from. Secrets are redacted.",
+}
+
+var configSchemaCmd = &cobra.Command{
+	Run:   printSchema,
+	Use:   "schema",
+	Short: "print the JSON Schema of the configuration file",
+}
+
+func init() {
+	configPrintCmd.Flags().String("format", "json", "the output format: json or yaml")
+	configCmd.AddCommand(configPrintCmd, configSchemaCmd)
+}
+
+func printConfig(cmd *cobra.Command, _ []string) {
+	config, err := conf.LoadConfig(cmd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	format, _ := cmd.Flags().GetString("format")
+	out, err := describeConfig(config, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(string(out))
+}
+
+func describeConfig(config *conf.Config, format string) ([]byte, error) {
+	description, err := config.Describe()
+	if err != nil {
+		return nil, err
+	}
+	return description.Format(format)
+}
+
+func printSchema(_ *cobra.Command, _ []string) {
+	schema, err := conf.Schema()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(schema)
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/netlify/elastinats/conf"
+	"github.com/netlify/elastinats/elastic"
+	"github.com/netlify/elastinats/messaging"
+	"github.com/netlify/elastinats/stats"
+)
+
+// consumers starts a batcher for each distinct endpoint, subjects that send to
+// the same endpoint share it
+type consumers struct {
+	bufferSize int64
+	reportSec  int64
+	log        *logrus.Entry
+
+	byEndpoint map[string]*batcher
+
+	// used are the endpoints that were asked for since begin, started are the
+	// batchers that were started for them. The previous settings are restored
+	// by rollback.
+	used              map[string]bool
+	started           map[string]bool
+	previousBuffer    int64
+	previousReportSec int64
+}
+
+// batcher is a running BatchAndSend along with its stats
+type batcher struct {
+	endpoint  *conf.ElasticConfig
+	incoming  chan<- messaging.Message
+	sender    *elastic.Batcher
+	stats     *stats.Counters
+	reporting chan<- bool
+	log       *logrus.Entry
+	started   time.Time
+
+	// seriesID tells the metrics of endpoints apart that only differ in
+	// settings that aren't labels
+	seriesID string
+}
+
+func newConsumers(log *logrus.Entry) *consumers {
+	return &consumers{
+		log:        log,
+		byEndpoint: make(map[string]*batcher),
+		used:       make(map[string]bool),
+		started:    make(map[string]bool),
+	}
+}
+
+// begin sets what new batchers are started with. The running ones aren't
+// changed until commit.
+func (c *consumers) begin(bufferSize, reportSec int64) {
+	c.previousBuffer, c.previousReportSec = c.bufferSize, c.reportSec
+	c.bufferSize = bufferSize
+	c.reportSec = reportSec
+	c.used = make(map[string]bool)
+	c.started = make(map[string]bool)
+}
+
+// commit restarts the reporting of the batchers that keep running if the
+// interval changed, and stops the ones that are no longer used
+func (c *consumers) commit() {
+	if c.reportSec != c.previousReportSec {
+		for key, b := range c.byEndpoint {
+			if c.used[key] && !c.started[key] {
+				close(b.reporting)
+				b.reporting = b.stats.StartReporting(c.reportSec, b.log)
+			}
+		}
+	}
+	c.stopUnused()
+	c.started = make(map[string]bool)
+}
+
+// rollback stops the batchers that were started since begin and goes back to
+// the previous settings. Nothing can be sending to them anymore.
+func (c *consumers) rollback() {
+	for key := range c.started {
+		b := c.byEndpoint[key]
+		close(b.reporting)
+		b.sender.Shutdown()
+		delete(c.byEndpoint, key)
+	}
+
+	c.bufferSize, c.reportSec = c.previousBuffer, c.previousReportSec
+	c.used = make(map[string]bool)
+	c.started = make(map[string]bool)
+}
+
+// get returns the batcher for the endpoint, starting it if it is the first subject using it
+func (c *consumers) get(el *conf.ElasticConfig) (chan<- messaging.Message, error) {
+	key, err := c.endpointKey(el)
+	if err != nil {
+		return nil, err
+	}
+	c.used[key] = true
+
+	if b, ok := c.byEndpoint[key]; ok {
+		c.log.WithField("index", el.Index).Debug("Sharing consumer for endpoint")
+		return b.incoming, nil
+	}
+
+	log := c.log.WithFields(logrus.Fields{
+		"hosts": el.Hosts,
+		"type":  el.Type,
+		"index": el.Index,
+	})
+	log.Debug("Starting consumer for endpoint")
+
+	b := buildConsumer(el, c.bufferSize, c.reportSec, log)
+	c.byEndpoint[key] = b
+	c.started[key] = true
+	return b.incoming, nil
+}
+
+// stopUnused sends the last batch of every batcher that wasn't asked for since
+// begin and stops it. Nothing can be sending to them anymore.
+func (c *consumers) stopUnused() {
+	for key, b := range c.byEndpoint {
+		if c.used[key] {
+			continue
+		}
+
+		b.log.Info("Stopping consumer for endpoint that is no longer used")
+		close(b.reporting)
+		b.sender.Shutdown()
+		delete(c.byEndpoint, key)
+	}
+}
+
+// endpointKey identifies the effective settings of an endpoint, two configs
+// with the same key would batch to the same place in the same way
+func (c *consumers) endpointKey(el *conf.ElasticConfig) (string, error) {
+	bs, err := json.Marshal(el)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%s", c.bufferSize, bs), nil
+}
+
+func buildConsumer(el *conf.ElasticConfig, bufferSize, reportSec int64, log *logrus.Entry) *batcher {
+	stats := stats.NewCounter(el)
+
+	c := make(chan messaging.Message, bufferSize)
+	return &batcher{
+		endpoint:  el,
+		incoming:  c,
+		sender:    elastic.BatchAndSend(el, c, stats, log),
+		stats:     stats,
+		reporting: stats.StartReporting(reportSec, log),
+		log:       log,
+		started:   time.Now(),
+		seriesID:  nextSeriesID(),
+	}
+}
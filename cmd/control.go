@@ -0,0 +1,324 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/netlify/elastinats/stats"
+)
+
+type subscriptionInfo struct {
+	Subject      string                 `json:"subject"`
+	Group        string                 `json:"group"`
+	Connection   string                 `json:"connection"`
+	Index        string                 `json:"index"`
+	Status       string                 `json:"status"`
+	PendingMsgs  int                    `json:"pending_msgs"`
+	PendingBytes int                    `json:"pending_bytes"`
+	Delivered    int64                  `json:"delivered_msgs"`
+	Dropped      int                    `json:"dropped_msgs"`
+	Stats        *stats.SubjectCounters `json:"stats"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+type batcherInfo struct {
+	Index           string                     `json:"index"`
+	Hosts           []string                   `json:"hosts"`
+	BatchSize       int                        `json:"batch_size"`
+	BatchTimeoutSec int                        `json:"batch_timeout_sec"`
+	Buffered        int                        `json:"buffered"`
+	BufferSize      int                        `json:"buffer_size"`
+	MessagesRx      int64                      `json:"messages_rx"`
+	MessagesTx      int64                      `json:"messages_tx"`
+	BatchesTx       int64                      `json:"batches_tx"`
+	BatchesFailed   int64                      `json:"batches_failed"`
+	Errors          map[string]int64           `json:"errors"`
+	HostStats       map[string]stats.HostStats `json:"host_stats"`
+	Flushed         *int                       `json:"flushed,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// handleControl adds the admin API, every request needs the bearer token
+func (r *runner) handleControl(mux *http.ServeMux, token string) {
+	mux.HandleFunc("/subscriptions", authorized(token, http.MethodGet, r.listSubscriptions))
+	mux.HandleFunc("/subscriptions/pause", authorized(token, http.MethodPost, r.pauseSubscriptions))
+	mux.HandleFunc("/subscriptions/resume", authorized(token, http.MethodPost, r.resumeSubscriptions))
+	mux.HandleFunc("/batchers", authorized(token, http.MethodGet, r.listBatchers))
+	mux.HandleFunc("/batchers/flush", authorized(token, http.MethodPost, r.flushBatchers))
+	mux.HandleFunc("/batchers/batching", authorized(token, http.MethodPost, r.setBatching))
+}
+
+func authorized(token, method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if token == "" {
+			writeJSON(w, http.StatusForbidden, &apiError{"The admin API is disabled - set admin_conf.token to enable it"})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, &apiError{"A valid bearer token is required"})
+			return
+		}
+		if req.Method != method {
+			writeJSON(w, http.StatusMethodNotAllowed, &apiError{"Method not allowed"})
+			return
+		}
+		next(w, req)
+	}
+}
+
+// matchingSubscriptions are the subscriptions that match the subject, group and
+// connection query parameters that are set, in a stable order
+func (r *runner) matchingSubscriptions(query url.Values) []*subscription {
+	matching := []*subscription{}
+	for _, key := range sortedKeys(r.subscriptions) {
+		s := r.subscriptions[key]
+		pair := s.settings()
+		if matches(query.Get("subject"), pair.Subject) &&
+			matches(query.Get("group"), pair.Group) &&
+			matches(query.Get("connection"), pair.ConnectionName()) {
+			matching = append(matching, s)
+		}
+	}
+	return matching
+}
+
+// matchingBatchers are the batchers that match the index and host query
+// parameters that are set
+func (r *runner) matchingBatchers(query url.Values) []*batcher {
+	matching := []*batcher{}
+	for _, b := range r.allBatchers() {
+		if !matches(query.Get("index"), b.endpoint.Index) {
+			continue
+		}
+		if host := query.Get("host"); host != "" && !contains(b.endpoint.Hosts, host) {
+			continue
+		}
+		matching = append(matching, b)
+	}
+	return matching
+}
+
+// allBatchers are the running batchers by index, the lock has to be held
+func (r *runner) allBatchers() []*batcher {
+	all := make([]*batcher, 0, len(r.consumers.byEndpoint))
+	for _, b := range r.consumers.byEndpoint {
+		all = append(all, b)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].endpoint.Index < all[j].endpoint.Index
+	})
+	return all
+}
+
+func matches(filter, value string) bool {
+	return filter == "" || filter == value
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *runner) subscriptionInfo(s *subscription) *subscriptionInfo {
+	pair := s.settings()
+	info := &subscriptionInfo{
+		Subject:    pair.Subject,
+		Group:      pair.Group,
+		Connection: pair.ConnectionName(),
+		Status:     s.status(),
+		Stats:      s.stats.Snapshot(),
+	}
+	if endpoint, err := r.config.Endpoint(pair); err == nil {
+		info.Index = endpoint.Index
+	}
+	info.PendingMsgs, info.PendingBytes, _ = s.Pending()
+	info.Delivered, _ = s.Delivered()
+	info.Dropped, _ = s.Dropped()
+	return info
+}
+
+func batcherInfoFor(b *batcher) *batcherInfo {
+	info := &batcherInfo{
+		Index:         b.endpoint.Index,
+		Hosts:         b.endpoint.Hosts,
+		Buffered:      len(b.incoming),
+		BufferSize:    cap(b.incoming),
+		MessagesRx:    atomic.LoadInt64(&b.stats.MessagsConsumed),
+		MessagesTx:    atomic.LoadInt64(&b.stats.MessagesSent),
+		BatchesTx:     atomic.LoadInt64(&b.stats.BatchesSent),
+		BatchesFailed: atomic.LoadInt64(&b.stats.BatchesFailed),
+		Errors:        b.stats.Errors(),
+		HostStats:     b.stats.HostStats(),
+	}
+	info.BatchSize, info.BatchTimeoutSec = b.stats.Batching()
+	return info
+}
+
+// listSubscriptions responds with the matching subscriptions and their stats
+func (r *runner) listSubscriptions(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	infos := []*subscriptionInfo{}
+	for _, s := range r.matchingSubscriptions(req.URL.Query()) {
+		infos = append(infos, r.subscriptionInfo(s))
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// pauseSubscriptions holds the matching subscriptions until they're resumed
+func (r *runner) pauseSubscriptions(w http.ResponseWriter, req *http.Request) {
+	r.changeSubscriptions(w, req, func(s *subscription) error {
+		return s.hold(r.subs)
+	})
+}
+
+// resumeSubscriptions releases the matching subscriptions
+func (r *runner) resumeSubscriptions(w http.ResponseWriter, req *http.Request) {
+	r.changeSubscriptions(w, req, func(s *subscription) error {
+		return s.release(r.subs)
+	})
+}
+
+func (r *runner) changeSubscriptions(w http.ResponseWriter, req *http.Request, change func(*subscription) error) {
+	r.mu.Lock()
+	matching := r.matchingSubscriptions(req.URL.Query())
+	r.mu.Unlock()
+	if len(matching) == 0 {
+		writeJSON(w, http.StatusNotFound, &apiError{"No subscription matches"})
+		return
+	}
+
+	// holding waits for the subscriptions to drain, they do that side by side and
+	// without the lock, so that the metrics and health checks don't wait for them
+	errs := make([]error, len(matching))
+	wg := sync.WaitGroup{}
+	for i, s := range matching {
+		wg.Add(1)
+		go func(i int, s *subscription) {
+			defer wg.Done()
+			errs[i] = change(s)
+		}(i, s)
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := http.StatusOK
+	infos := []*subscriptionInfo{}
+	for i, s := range matching {
+		info := r.subscriptionInfo(s)
+		if err := errs[i]; err != nil {
+			s.log.WithError(err).Warn("Failed to change the subscription through the admin API")
+			info.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+		infos = append(infos, info)
+	}
+	writeJSON(w, status, infos)
+}
+
+// listBatchers responds with the matching batchers and their stats
+func (r *runner) listBatchers(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	infos := []*batcherInfo{}
+	for _, b := range r.matchingBatchers(req.URL.Query()) {
+		infos = append(infos, batcherInfoFor(b))
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// flushBatchers sends the current batch of the matching batchers right away
+func (r *runner) flushBatchers(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	matching := r.matchingBatchers(req.URL.Query())
+	if len(matching) == 0 {
+		writeJSON(w, http.StatusNotFound, &apiError{"No batcher matches"})
+		return
+	}
+
+	infos := []*batcherInfo{}
+	for _, b := range matching {
+		flushed := b.sender.Flush()
+		info := batcherInfoFor(b)
+		info.Flushed = &flushed
+		infos = append(infos, info)
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// setBatching changes the batch_size and batch_timeout_sec of the matching
+// batchers, until a config change restarts them
+func (r *runner) setBatching(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	size, err := positiveParam(query.Get("batch_size"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &apiError{fmt.Sprintf("Invalid batch_size: %v", err)})
+		return
+	}
+	timeoutSec, err := positiveParam(query.Get("batch_timeout_sec"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &apiError{fmt.Sprintf("Invalid batch_timeout_sec: %v", err)})
+		return
+	}
+	if size == 0 && timeoutSec == 0 {
+		writeJSON(w, http.StatusBadRequest, &apiError{"Set batch_size, batch_timeout_sec or both"})
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	matching := r.matchingBatchers(req.URL.Query())
+	if len(matching) == 0 {
+		writeJSON(w, http.StatusNotFound, &apiError{"No batcher matches"})
+		return
+	}
+
+	infos := []*batcherInfo{}
+	for _, b := range matching {
+		currentSize, currentTimeout := b.stats.Batching()
+		if size > 0 {
+			currentSize = size
+		}
+		if timeoutSec > 0 {
+			currentTimeout = timeoutSec
+		}
+		b.sender.SetBatching(currentSize, currentTimeout)
+		infos = append(infos, batcherInfoFor(b))
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// positiveParam parses a query parameter that has to be above 0, it is 0 if it isn't set
+func positiveParam(raw string) (int, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, err
+	}
+	if value <= 0 {
+		return 0, fmt.Errorf("it must be above 0, not %d", value)
+	}
+	return value, nil
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+var startedAt = time.Now()
+
+type health struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	Uptime  string `json:"uptime"`
+}
+
+// readiness is the detail of /readyz, Ready is only true if every check is OK
+type readiness struct {
+	Ready         bool                  `json:"ready"`
+	Connections   []connectionReadiness `json:"connections"`
+	Subscriptions []subjectReadiness    `json:"subscriptions"`
+	Endpoints     []endpointReadiness   `json:"endpoints"`
+}
+
+type connectionReadiness struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Status string `json:"status"`
+}
+
+type subjectReadiness struct {
+	Subject    string `json:"subject"`
+	Group      string `json:"group"`
+	Connection string `json:"connection"`
+	OK         bool   `json:"ok"`
+	Status     string `json:"status"`
+}
+
+type endpointReadiness struct {
+	Index       string     `json:"index"`
+	Hosts       []string   `json:"hosts"`
+	OK          bool       `json:"ok"`
+	Problem     string     `json:"problem,omitempty"`
+	LastBulk    *time.Time `json:"last_bulk"`
+	LastSuccess *time.Time `json:"last_success"`
+	Buffered    int        `json:"buffered"`
+	BufferSize  int        `json:"buffer_size"`
+}
+
+// serveHealth responds as long as the process is running
+func (r *runner) serveHealth(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, &health{
+		Status:  "ok",
+		Version: Version,
+		Uptime:  time.Since(startedAt).Round(time.Second).String(),
+	})
+}
+
+// serveReady responds with 200 if the process can do its work and 503 if it
+// can't, the body has the detail of every check
+func (r *runner) serveReady(w http.ResponseWriter, req *http.Request) {
+	ready := r.readiness(time.Now())
+	status := http.StatusOK
+	if !ready.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, ready)
+}
+
+// readiness checks that the nats connections are connected, that every
+// subscription is active, and that the endpoints can send their batches
+func (r *runner) readiness(now time.Time) *readiness {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ready := &readiness{
+		Ready:         r.config != nil,
+		Connections:   []connectionReadiness{},
+		Subscriptions: []subjectReadiness{},
+		Endpoints:     []endpointReadiness{},
+	}
+	if r.config == nil {
+		return ready
+	}
+
+	names := make([]string, 0, len(r.conns))
+	for name := range r.conns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		nc := r.conns[name].nc
+		check := connectionReadiness{
+			Name:   name,
+			OK:     nc.Status() == nats.CONNECTED,
+			Status: nc.Status().String(),
+		}
+		ready.Ready = ready.Ready && check.OK
+		ready.Connections = append(ready.Connections, check)
+	}
+
+	for _, key := range sortedKeys(r.subscriptions) {
+		s := r.subscriptions[key]
+		pair := s.settings()
+		check := subjectReadiness{
+			Subject:    pair.Subject,
+			Group:      pair.Group,
+			Connection: pair.ConnectionName(),
+			Status:     s.status(),
+		}
+		check.OK = check.Status == statusActive
+
+		ready.Ready = ready.Ready && check.OK
+		ready.Subscriptions = append(ready.Subscriptions, check)
+	}
+
+	maxFailing, bufferPercent := r.config.AdminConf.ReadyThresholds()
+	for _, b := range r.consumers.byEndpoint {
+		check := endpointReadiness{
+			Index:      b.endpoint.Index,
+			Hosts:      b.endpoint.Hosts,
+			OK:         true,
+			Buffered:   len(b.incoming),
+			BufferSize: cap(b.incoming),
+		}
+
+		lastBulk, lastSuccess := b.stats.LastBulk()
+		if !lastBulk.IsZero() {
+			check.LastBulk = &lastBulk
+		}
+		if !lastSuccess.IsZero() {
+			check.LastSuccess = &lastSuccess
+		}
+
+		// idle endpoints are fine, it's only a problem if the requests keep failing
+		since := lastSuccess
+		if since.IsZero() {
+			since = b.started
+		}
+		if lastBulk.After(lastSuccess) && now.Sub(since) > maxFailing {
+			check.OK = false
+			check.Problem = fmt.Sprintf("No bulk request succeeded for %s", now.Sub(since).Round(time.Second))
+		}
+		if check.BufferSize > 0 && check.Buffered*100 >= check.BufferSize*bufferPercent {
+			check.OK = false
+			check.Problem = fmt.Sprintf("The buffer is %d%% full", check.Buffered*100/check.BufferSize)
+		}
+
+		ready.Ready = ready.Ready && check.OK
+		ready.Endpoints = append(ready.Endpoints, check)
+	}
+	sort.Slice(ready.Endpoints, func(i, j int) bool {
+		return ready.Endpoints[i].Index < ready.Endpoints[j].Index
+	})
+
+	return ready
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/elastinats/conf"
+)
+
+func getReady(t *testing.T, r *runner) (int, *readiness) {
+	rec := adminRequest(r.adminHandler(""), http.MethodGet, "/readyz", "")
+	ready := new(readiness)
+	if err := json.Unmarshal(rec.Body.Bytes(), ready); err != nil {
+		t.Fatalf("Failed to parse the readiness: %v", err)
+	}
+	return rec.Code, ready
+}
+
+func TestReadyzWithoutConfig(t *testing.T) {
+	code, ready := getReady(t, newRunner(testLog))
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, ready.Ready)
+}
+
+func TestReadyzNatsDisconnected(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	es := startTestElastic()
+	defer es.Close()
+
+	r := newRunner(testLog)
+	assert.Nil(t, r.apply(testConfig(server, es, conf.SubjectAndGroup{Subject: "logs"})))
+
+	code, ready := getReady(t, r)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, ready.Ready)
+	if assert.Len(t, ready.Connections, 1) {
+		assert.Equal(t, connectionReadiness{Name: "default", OK: true, Status: "CONNECTED"}, ready.Connections[0])
+	}
+	if assert.Len(t, ready.Subscriptions, 1) {
+		assert.Equal(t, statusActive, ready.Subscriptions[0].Status)
+	}
+
+	server.Close()
+	eventually(t, "the connection to drop", func() bool {
+		code, _ := getReady(t, r)
+		return code == http.StatusServiceUnavailable
+	})
+	_, ready = getReady(t, r)
+	assert.False(t, ready.Ready)
+	assert.False(t, ready.Connections[0].OK)
+	assert.NotEqual(t, "CONNECTED", ready.Connections[0].Status)
+}
+
+func TestReadyzBatcherStuck(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	es := startTestElastic()
+	defer es.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	broken := &testElastic{Server: failing}
+
+	r := newRunner(testLog)
+	assert.Nil(t, r.apply(testConfig(server, es,
+		conf.SubjectAndGroup{Subject: "logs"},
+		conf.SubjectAndGroup{Subject: "audit", Endpoint: broken.endpoint("audit")},
+	)))
+	eventually(t, "the subscription", func() bool { return server.Subscriptions("audit") == 1 })
+
+	publish(t, server, "audit", "lost")
+	eventually(t, "the failed bulk request", func() bool {
+		for _, b := range r.consumers.byEndpoint {
+			if lastBulk, _ := b.stats.LastBulk(); b.endpoint.Index == "audit" && !lastBulk.IsZero() {
+				return true
+			}
+		}
+		return false
+	})
+
+	// it is only a problem once it kept failing for longer than ready_bulk_sec
+	code, _ := getReady(t, r)
+	assert.Equal(t, http.StatusOK, code)
+
+	ready := r.readiness(time.Now().Add(3 * time.Minute))
+	assert.False(t, ready.Ready)
+	if assert.Len(t, ready.Endpoints, 2) {
+		audit, logs := ready.Endpoints[0], ready.Endpoints[1]
+		assert.False(t, audit.OK)
+		assert.Contains(t, audit.Problem, "No bulk request succeeded for")
+		assert.NotNil(t, audit.LastBulk)
+		assert.Nil(t, audit.LastSuccess)
+		// the idle endpoint is fine
+		assert.True(t, logs.OK)
+	}
+}
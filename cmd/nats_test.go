@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer speaks enough of the nats protocol for the client to connect,
+// subscribe, publish and make requests. There is no nats-server to test against.
+type testServer struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	clients map[*testClient]bool
+}
+
+type testClient struct {
+	conn         net.Conn
+	noResponders bool
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	// guarded by the server mutex
+	subs map[string]*testSub
+}
+
+type testSub struct {
+	client  *testClient
+	sid     string
+	subject string
+	queue   string
+}
+
+func startTestServer(t *testing.T) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	s := &testServer{ln: ln, clients: make(map[*testClient]bool)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) URL() string {
+	return "nats://" + s.ln.Addr().String()
+}
+
+// Close stops accepting and drops every client, they'll try to reconnect
+func (s *testServer) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// Subscriptions counts the subscriptions on the subject over every client
+func (s *testServer) Subscriptions(subject string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for c := range s.clients {
+		for _, sub := range c.subs {
+			if sub.subject == subject {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// Clients is the number of connected clients
+func (s *testServer) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	c := &testClient{conn: conn, w: bufio.NewWriter(conn), subs: make(map[string]*testSub)}
+	s.mu.Lock()
+	s.clients[c] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	c.send(fmt.Sprintf(`INFO {"server_id":"test","version":"2.10.0","proto":1,"headers":true,"max_payload":1048576,"host":%q,"port":%s}`+"\r\n", host, port), nil)
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "CONNECT":
+			var opts struct {
+				NoResponders bool `json:"no_responders"`
+			}
+			json.Unmarshal([]byte(strings.TrimSpace(line[len("CONNECT"):])), &opts)
+			c.noResponders = opts.NoResponders
+		case "PING":
+			c.send("PONG\r\n", nil)
+		case "SUB":
+			sub := &testSub{client: c, subject: args[1], sid: args[len(args)-1]}
+			if len(args) == 4 {
+				sub.queue = args[2]
+			}
+			s.mu.Lock()
+			c.subs[sub.sid] = sub
+			s.mu.Unlock()
+		case "UNSUB":
+			s.mu.Lock()
+			delete(c.subs, args[1])
+			s.mu.Unlock()
+		case "PUB", "HPUB":
+			headers := args[0] == "HPUB"
+			sizes := 1
+			if headers {
+				sizes = 2
+			}
+			subject, reply := args[1], ""
+			if len(args) == 2+sizes+1 {
+				reply = args[2]
+			}
+			total, _ := strconv.Atoi(args[len(args)-1])
+			hdrLen := ""
+			if headers {
+				hdrLen = args[len(args)-2]
+			}
+
+			body := make([]byte, total+2)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return
+			}
+			s.route(c, subject, reply, hdrLen, body[:total])
+		}
+	}
+}
+
+// route delivers the message to every plain subscription and one member of
+// each queue group
+func (s *testServer) route(from *testClient, subject, reply, hdrLen string, body []byte) {
+	s.mu.Lock()
+	matching := []*testSub{}
+	groups := map[string]bool{}
+	for c := range s.clients {
+		for _, sub := range c.subs {
+			if !subjectMatches(sub.subject, subject) {
+				continue
+			}
+			if sub.queue != "" {
+				if groups[sub.queue] {
+					continue
+				}
+				groups[sub.queue] = true
+			}
+			matching = append(matching, sub)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(matching) == 0 && reply != "" && from.noResponders {
+		status := "NATS/1.0 503\r\n\r\n"
+		from.send(fmt.Sprintf("HMSG %s %s %d %d\r\n", reply, from.sidFor(s, reply), len(status), len(status)), []byte(status))
+		return
+	}
+
+	for _, sub := range matching {
+		op := "MSG"
+		sizes := strconv.Itoa(len(body))
+		if hdrLen != "" {
+			op = "HMSG"
+			sizes = hdrLen + " " + sizes
+		}
+		if reply != "" {
+			sizes = reply + " " + sizes
+		}
+		sub.client.send(fmt.Sprintf("%s %s %s %s\r\n", op, subject, sub.sid, sizes), body)
+	}
+}
+
+// sidFor finds the subscription of the client that the reply goes to
+func (c *testClient) sidFor(s *testServer, reply string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range c.subs {
+		if subjectMatches(sub.subject, reply) {
+			return sub.sid
+		}
+	}
+	return "0"
+}
+
+func (c *testClient) send(line string, body []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.w.WriteString(line)
+	if body != nil {
+		c.w.Write(body)
+		c.w.WriteString("\r\n")
+	}
+	c.w.Flush()
+}
+
+func subjectMatches(pattern, subject string) bool {
+	want, got := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, token := range want {
+		if token == ">" {
+			return len(got) > i
+		}
+		if i >= len(got) || (token != "*" && token != got[i]) {
+			return false
+		}
+	}
+	return len(want) == len(got)
+}
+
+// eventually waits for the condition to be true
+func eventually(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nats-io/nats.go"
+
+	"github.com/netlify/elastinats/conf"
+)
+
+// statsReport is the document that is published to nats
+type statsReport struct {
+	Hostname      string              `json:"hostname"`
+	Version       string              `json:"version"`
+	Time          time.Time           `json:"time"`
+	Connections   []*connectionStats  `json:"connections"`
+	Subscriptions []*subscriptionInfo `json:"subscriptions"`
+	Endpoints     []*batcherInfo      `json:"endpoints"`
+}
+
+type connectionStats struct {
+	Name        string `json:"name"`
+	Status      string `json:"status"`
+	MessagesRx  uint64 `json:"messages_rx"`
+	MessagesTx  uint64 `json:"messages_tx"`
+	BytesRx     uint64 `json:"bytes_rx"`
+	BytesTx     uint64 `json:"bytes_tx"`
+	Disconnects int64  `json:"disconnects"`
+	Reconnects  int64  `json:"reconnects"`
+}
+
+// statsPublisher publishes the stats report every report_sec and answers the
+// requests for it
+type statsPublisher struct {
+	config    conf.StatsConfig
+	conn      *connection
+	reportSec int64
+	log       *logrus.Entry
+
+	sub      *nats.Subscription
+	shutdown chan bool
+}
+
+// configurePublisher starts, restarts or stops publishing the stats to match the
+// config. It doesn't fail the config if that doesn't work.
+func (r *runner) configurePublisher(config *conf.Config, conns map[string]*connection) {
+	var want conf.StatsConfig
+	if config.StatsConf != nil {
+		want = config.StatsConf.WithDefaults()
+	}
+
+	if p := r.publisher; p != nil {
+		if config.StatsConf != nil && p.config == want && p.conn == conns[want.Connection] && p.reportSec == config.ReportSec {
+			return
+		}
+		p.stop()
+		r.publisher = nil
+	}
+	if config.StatsConf == nil {
+		return
+	}
+
+	p, err := r.startPublisher(want, conns[want.Connection], config.ReportSec)
+	if err != nil {
+		r.log.WithError(err).Error("Failed to start publishing the stats")
+		return
+	}
+	r.publisher = p
+}
+
+func (r *runner) startPublisher(config conf.StatsConfig, conn *connection, reportSec int64) (*statsPublisher, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	subject := config.PublishSubject(hostname)
+	p := &statsPublisher{
+		config:    config,
+		conn:      conn,
+		reportSec: reportSec,
+		shutdown:  make(chan bool),
+		log: r.log.WithFields(logrus.Fields{
+			"stats_subject":   subject,
+			"request_subject": config.RequestSubject,
+			"connection":      config.Connection,
+		}),
+	}
+
+	p.sub, err = conn.nc.Subscribe(config.RequestSubject, func(m *nats.Msg) {
+		if m.Reply == "" {
+			return
+		}
+		if err := m.Respond(r.marshalReport(hostname)); err != nil {
+			p.log.WithError(err).Warn("Failed to respond with the stats")
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if reportSec > 0 {
+		go func() {
+			ticks := time.NewTicker(time.Duration(reportSec) * time.Second)
+			defer ticks.Stop()
+			for {
+				select {
+				case <-ticks.C:
+					if err := conn.nc.Publish(subject, r.marshalReport(hostname)); err != nil {
+						p.log.WithError(err).Warn("Failed to publish the stats")
+					}
+				case <-p.shutdown:
+					return
+				}
+			}
+		}()
+	}
+
+	p.log.Info("Publishing the stats")
+	return p, nil
+}
+
+func (p *statsPublisher) stop() {
+	close(p.shutdown)
+	if err := p.sub.Unsubscribe(); err != nil {
+		p.log.WithError(err).Warn("Failed to unsubscribe from the stats requests")
+	}
+}
+
+// marshalReport builds the current report as JSON
+func (r *runner) marshalReport(hostname string) []byte {
+	r.mu.Lock()
+	report := r.report(hostname)
+	r.mu.Unlock()
+
+	bs, err := json.Marshal(report)
+	if err != nil {
+		// there is nothing in there that can't be marshalled
+		r.log.WithError(err).Error("Failed to marshal the stats")
+	}
+	return bs
+}
+
+// report collects the stats of every connection, subscription and endpoint, the
+// lock has to be held
+func (r *runner) report(hostname string) *statsReport {
+	report := &statsReport{
+		Hostname:      hostname,
+		Version:       Version,
+		Time:          time.Now().UTC(),
+		Connections:   []*connectionStats{},
+		Subscriptions: []*subscriptionInfo{},
+		Endpoints:     []*batcherInfo{},
+	}
+
+	names := make([]string, 0, len(r.conns))
+	for name := range r.conns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		conn := r.conns[name]
+		nc := conn.nc.Stats()
+		report.Connections = append(report.Connections, &connectionStats{
+			Name:        name,
+			Status:      conn.nc.Status().String(),
+			MessagesRx:  nc.InMsgs,
+			MessagesTx:  nc.OutMsgs,
+			BytesRx:     nc.InBytes,
+			BytesTx:     nc.OutBytes,
+			Disconnects: atomic.LoadInt64(&conn.stats.Disconnects),
+			Reconnects:  atomic.LoadInt64(&conn.stats.Reconnects),
+		})
+	}
+
+	for _, key := range sortedKeys(r.subscriptions) {
+		report.Subscriptions = append(report.Subscriptions, r.subscriptionInfo(r.subscriptions[key]))
+	}
+	for _, b := range r.allBatchers() {
+		report.Endpoints = append(report.Endpoints, batcherInfoFor(b))
+	}
+	return report
+}
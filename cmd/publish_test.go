@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/elastinats/conf"
+)
+
+func TestStatsRequest(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	es := startTestElastic()
+	defer es.Close()
+
+	config := testConfig(server, es, conf.SubjectAndGroup{Subject: "logs", Group: "shared"})
+	config.StatsConf = &conf.StatsConfig{RequestSubject: "stats.request"}
+	r := newRunner(testLog)
+	assert.Nil(t, r.apply(config))
+	eventually(t, "the request subscription", func() bool { return server.Subscriptions("stats.request") == 1 })
+
+	publish(t, server, "logs", "line")
+	eventually(t, "the document", func() bool { return es.Docs("logs") == 1 })
+
+	nc, err := nats.Connect(server.URL())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer nc.Close()
+
+	reply, err := nc.Request("stats.request", nil, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to request the stats: %v", err)
+	}
+	report := new(statsReport)
+	assert.Nil(t, json.Unmarshal(reply.Data, report))
+
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostname, report.Hostname)
+	assert.Equal(t, Version, report.Version)
+	if assert.Len(t, report.Connections, 1) {
+		assert.Equal(t, "default", report.Connections[0].Name)
+		assert.Equal(t, "CONNECTED", report.Connections[0].Status)
+	}
+	if assert.Len(t, report.Subscriptions, 1) {
+		s := report.Subscriptions[0]
+		assert.Equal(t, "logs", s.Subject)
+		assert.Equal(t, "shared", s.Group)
+		assert.Equal(t, "logs", s.Index)
+		assert.Equal(t, statusActive, s.Status)
+		assert.EqualValues(t, 1, s.Stats.MessagesConsumed)
+		assert.EqualValues(t, 1, s.Stats.MessagesSent)
+	}
+	if assert.Len(t, report.Endpoints, 1) {
+		assert.Equal(t, "logs", report.Endpoints[0].Index)
+		assert.EqualValues(t, 1, report.Endpoints[0].MessagesTx)
+	}
+}
+
+func TestStatsArePublished(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	es := startTestElastic()
+	defer es.Close()
+
+	nc, err := nats.Connect(server.URL())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer nc.Close()
+	reports, err := nc.SubscribeSync("stats.>")
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	assert.Nil(t, nc.Flush())
+
+	config := testConfig(server, es, conf.SubjectAndGroup{Subject: "logs"})
+	config.StatsConf = &conf.StatsConfig{Subject: "stats.{hostname}"}
+	config.ReportSec = 1
+	r := newRunner(testLog)
+	assert.Nil(t, r.apply(config))
+
+	msg, err := reports.NextMsg(3 * time.Second)
+	if err != nil {
+		t.Fatalf("No stats were published: %v", err)
+	}
+	hostname, _ := os.Hostname()
+	assert.Equal(t, config.StatsConf.PublishSubject(hostname), msg.Subject)
+
+	report := new(statsReport)
+	assert.Nil(t, json.Unmarshal(msg.Data, report))
+	assert.Equal(t, hostname, report.Hostname)
+	if assert.Len(t, report.Subscriptions, 1) {
+		assert.Equal(t, "logs", report.Subscriptions[0].Subject)
+	}
+
+	// stopping publishing stops the reports
+	config = testConfig(server, es, conf.SubjectAndGroup{Subject: "logs"})
+	assert.Nil(t, r.apply(config))
+	assert.Nil(t, r.publisher)
+}
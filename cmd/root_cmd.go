@@ -2,15 +2,18 @@ package cmd
 
 import (
 	"encoding/json"
+	"sync/atomic"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/nats-io/nats"
+	"github.com/nats-io/nats.go"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 
 	"github.com/netlify/elastinats/conf"
-	"github.com/netlify/elastinats/elastic"
+	"github.com/netlify/elastinats/enrich"
 	"github.com/netlify/elastinats/messaging"
 	"github.com/netlify/elastinats/stats"
+	"github.com/netlify/elastinats/watch"
 )
 
 var rootCmd = &cobra.Command{
@@ -21,7 +24,7 @@ var rootCmd = &cobra.Command{
 
 func RootCmd() *cobra.Command {
 	rootCmd.PersistentFlags().StringP("config", "c", "", "a config file to use")
-	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(versionCmd, validateCmd, configCmd)
 
 	return rootCmd
 }
@@ -39,76 +42,79 @@ func run(cmd *cobra.Command, _ []string) {
 
 	rootLogger.WithField("version", Version).Info("Configured - starting to connect and consume")
 
-	// connect to NATS
-	rootLogger.WithFields(logrus.Fields{
-		"servers":   config.NatsConf.Servers,
-		"ca_files":  config.NatsConf.CAFiles,
-		"key_file":  config.NatsConf.KeyFile,
-		"cert_file": config.NatsConf.CertFile,
-	}).Info("Connecting to Nats")
-	nc, err := messaging.ConnectToNats(&config.NatsConf, errorReporter(rootLogger))
-	if err != nil {
-		rootLogger.WithError(err).Fatal("Failed to connect to nats")
-	}
-
-	var defaultConsumer nats.MsgHandler
-	var defaultStats *stats.Counters
-	if config.ElasticConf != nil {
-		rootLogger.Debug("Starting default Consumer")
-		defaultStats, defaultConsumer = buildConsumer(config.ElasticConf, config.BufferSize, rootLogger)
-	}
-
-	for _, pair := range config.Subjects {
-		log := rootLogger.WithFields(logrus.Fields{
-			"subject": pair.Subject,
-			"group":   pair.Group,
-		})
-		log.Debug("Connecting channel")
-
-		// connect ~ does it go to the default or a custom one?
-		cons := defaultConsumer
-		st := defaultStats
-		if pair.Endpoint == nil && defaultConsumer == nil {
-			log.Fatal("No consumer provided and there is no default handler")
-		} else if pair.Endpoint == nil {
-			log.Debug("Using default consumer")
-		} else {
-			log.WithFields(logrus.Fields{
-				"hosts": pair.Endpoint.Hosts,
-				"type":  pair.Endpoint.Type,
-				"index": pair.Endpoint.Index,
-			}).Debugf("Starting consumer for endpoint")
-			st, cons = buildConsumer(pair.Endpoint, config.BufferSize, log)
-		}
-
-		// subscribe ~ queue or alone
-		var err error
-		var sub *nats.Subscription
-		if pair.Group == "" {
-			log.Debug("Subscribing")
-			sub, err = nc.Subscribe(pair.Subject, cons)
-		} else {
-			log.Debug("Subscribing to Queue")
-			sub, err = nc.QueueSubscribe(pair.Subject, pair.Group, cons)
-		}
-		if err != nil {
-			log.WithError(err).Fatal("Failed to subscribe")
-		}
+	r := newRunner(rootLogger)
+	if err := r.apply(config); err != nil {
+		rootLogger.WithError(err).Fatal("Failed to start consuming")
+	}
 
-		if err = sub.SetPendingLimits(-1, -1); err != nil {
-			log.WithError(err).Fatal("Failed to unlimit pending limits")
-		}
+	if config.AdminConf != nil {
+		startAdmin(config.AdminConf, r, rootLogger)
+	}
 
-		st.StartReporting(config.ReportSec, nc, sub, log)
-		log.Info("Started consuming from subject")
+	go r.reloadOnSignal(cmd)
+	if path := viper.ConfigFileUsed(); path != "" && config.WatchConfigSec > 0 {
+		go watch.File(path, int(config.WatchConfigSec), func() error {
+			return r.reload(cmd)
+		}, rootLogger.WithField("config_file", path), nil)
 	}
 
 	rootLogger.Info("Subscribed to all subject/groups - waiting")
 	select {}
 }
 
-func errorReporter(log *logrus.Entry) nats.ErrHandler {
+// connection is a nats connection along with its lifecycle counters
+type connection struct {
+	nc    *nats.Conn
+	key   string
+	stats *stats.ConnCounters
+
+	// retired is set once a reload stopped using the connection
+	retired int32
+}
+
+// retire drains the subscriptions that are left and closes the connection
+func (c *connection) retire() {
+	atomic.StoreInt32(&c.retired, 1)
+	if err := c.nc.Drain(); err != nil {
+		c.nc.Close()
+	}
+}
+
+func connect(name string, config *messaging.NatsConfig, subs *registry, log *logrus.Entry) (*connection, error) {
+	log = log.WithField("connection", name)
+	log.WithFields(logrus.Fields{
+		"servers":   config.Servers,
+		"tls":       config.UsesTLS(),
+		"ca_files":  config.CAFiles,
+		"key_file":  config.KeyFile,
+		"cert_file": config.CertFile,
+		"auth":      config.AuthMethod(),
+	}).Info("Connecting to Nats")
+
+	key, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	conn := &connection{
+		key:   string(key),
+		stats: new(stats.ConnCounters),
+	}
+
+	conn.nc, err = messaging.ConnectToNats(config, errorReporter(log, subs), connectionHandlers(config, conn, log)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func errorReporter(log *logrus.Entry, subs *registry) nats.ErrHandler {
 	return func(_ *nats.Conn, sub *nats.Subscription, err error) {
+		if sub == nil {
+			log.WithError(err).Warn("Error on the nats connection")
+			return
+		}
+
 		pendingMsgs, pendingBytes, _ := sub.Pending()
 		droppedMsgs, _ := sub.Dropped()
 		maxMsgs, maxBytes, _ := sub.PendingLimits()
@@ -122,24 +128,168 @@ func errorReporter(log *logrus.Entry) nats.ErrHandler {
 			"max_bytes_pending": maxBytes,
 			"dropped_msgs":      droppedMsgs,
 		}).Warn("Error while consuming from nats")
+
+		if err == nats.ErrSlowConsumer {
+			if s := subs.lookup(sub); s != nil {
+				s.slowConsumer(subs)
+			}
+		}
+	}
+}
+
+// connectionHandlers log and count the lifecycle events of the connection
+func connectionHandlers(config *messaging.NatsConfig, conn *connection, log *logrus.Entry) []nats.Option {
+	counters := conn.stats
+	return []nats.Option{
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			counters.IncrementDisconnects()
+			log.WithError(err).Warn("Disconnected from nats")
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			counters.IncrementReconnects()
+			log.WithField("server", nc.ConnectedUrl()).Info("Reconnected to nats")
+		}),
+		nats.DiscoveredServersHandler(func(nc *nats.Conn) {
+			counters.IncrementServersDiscovered()
+			log.WithField("servers", nc.DiscoveredServers()).Info("Discovered new nats servers")
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			if atomic.LoadInt32(&conn.retired) == 1 {
+				log.Info("Closed the nats connection that is no longer used")
+				return
+			}
+
+			log := log.WithError(nc.LastError())
+			if config.ExitOnClose() {
+				log.Fatal("Nats connection is closed for good - exiting")
+			}
+			log.Error("Nats connection is closed for good - waiting")
+		}),
 	}
 }
 
-func buildConsumer(el *conf.ElasticConfig, bufferSize int64, log *logrus.Entry) (*stats.Counters, nats.MsgHandler) {
-	stats := stats.NewCounter(el)
+func subscribeJetStream(nc *nats.Conn, pair *conf.SubjectAndGroup, handler nats.MsgHandler) (*nats.Subscription, error) {
+	opts, err := pair.JetStream.SubOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	if pair.Group == "" {
+		return js.Subscribe(pair.Subject, handler, opts...)
+	}
+	return js.QueueSubscribe(pair.Subject, pair.Group, handler, opts...)
+}
+
+// handler turns the nats messages of a subject into documents for its batcher
+type handler struct {
+	handle    nats.MsgHandler
+	multiline *messaging.Multiline
+}
+
+// close sends on the events that the handler is still joining lines for
+func (h *handler) close() {
+	if h.multiline != nil {
+		h.multiline.Close()
+	}
+}
+
+func buildHandler(pair *conf.SubjectAndGroup, c chan<- messaging.Message, stats *stats.SubjectCounters, enricher *enrich.Enricher, log *logrus.Entry) (*handler, error) {
+	var mapping *messaging.SubjectMapping
+	if pair.SubjectFields != "" {
+		var err error
+		if mapping, err = messaging.NewSubjectMapping(pair.SubjectFields); err != nil {
+			return nil, err
+		}
+	}
+
+	process := func(m *nats.Msg) messaging.Message {
+		data, err := messaging.DecodeBody(m.Data, m.Header)
+		if err != nil {
+			stats.IncrementDecodeErrors()
+			log.WithError(err).Debug("Failed to decode the message body - using it as is")
+			data = m.Data
+		}
+		payload := messaging.NewPayload(string(data), m.Subject)
+
+		// maybe it is json!
+		if messaging.ShouldParseJSON(m.Header) {
+			if err := json.Unmarshal(data, payload); err == nil {
+				stats.IncrementMessagesParsed()
+			}
+		}
+
+		if pair.Headers != nil {
+			pair.Headers.Apply(m.Header, *payload)
+		}
+
+		if mapping != nil {
+			mapping.Apply(m.Subject, *payload)
+		}
+
+		if enricher != nil {
+			enricher.Enrich(*payload)
+		}
 
-	c := make(chan messaging.Payload, bufferSize)
-	elastic.BatchAndSend(el, c, stats, log)
+		stats.IncrementPayloadLimits(payload.Shape(pair.PayloadConf))
 
-	return stats, func(m *nats.Msg) {
-		stats.IncrementMessagesConsumed()
-		go func() {
-			payload := messaging.NewPayload(string(m.Data), m.Subject)
+		var settle func(messaging.IndexResult)
+		switch {
+		case pair.JetStream != nil:
+			settle = func(res messaging.IndexResult) {
+				action, err := pair.JetStream.Settle(m, res)
+				stats.IncrementSettled(action)
+				if err != nil {
+					log.WithError(err).Warnf("Failed to %s message", action)
+				}
+			}
+		case pair.ReplyAck && m.Reply != "":
+			settle = func(res messaging.IndexResult) {
+				if err := m.Respond(res.Reply()); err != nil {
+					log.WithError(err).WithField("reply", m.Reply).Warn("Failed to send acknowledgement")
+					return
+				}
+				stats.IncrementRepliesSent()
+			}
+		}
 
-			// maybe it is json!
-			_ = json.Unmarshal(m.Data, payload)
+		done := func(res messaging.IndexResult) {
+			stats.IncrementResult(res)
+			if settle != nil {
+				settle(res)
+			}
+		}
 
-			c <- *payload
-		}()
+		return messaging.NewMessage(*payload, done)
 	}
+
+	if pair.Multiline != nil {
+		// the lines have to be handled in the order they come in, so this
+		// can't be pushed off to another routine
+		multiline, err := messaging.NewMultiline(pair.Multiline, c)
+		if err != nil {
+			return nil, err
+		}
+
+		return &handler{
+			handle: func(m *nats.Msg) {
+				stats.IncrementMessagesConsumed()
+				multiline.Add(process(m))
+			},
+			multiline: multiline,
+		}, nil
+	}
+
+	// this blocks when the backlog is full, so that the messages pile up in
+	// the nats client where the pending limits apply
+	return &handler{
+		handle: func(m *nats.Msg) {
+			stats.IncrementMessagesConsumed()
+			c <- process(m)
+		},
+	}, nil
 }
@@ -0,0 +1,315 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/netlify/elastinats/conf"
+	"github.com/netlify/elastinats/enrich"
+	"github.com/netlify/elastinats/messaging"
+)
+
+// runner owns everything that is running for the current config, so that a new
+// config can be applied without restarting the process
+type runner struct {
+	log *logrus.Entry
+
+	// reloading makes a SIGHUP and a changed file wait for each other, loading
+	// the config uses the global viper
+	reloading sync.Mutex
+
+	mu            sync.Mutex
+	config        *conf.Config
+	subs          *registry
+	conns         map[string]*connection
+	consumers     *consumers
+	enricher      *enrich.Enricher
+	subscriptions map[string]*subscription
+	publisher     *statsPublisher
+}
+
+func newRunner(log *logrus.Entry) *runner {
+	return &runner{
+		log:           log,
+		subs:          newRegistry(),
+		conns:         make(map[string]*connection),
+		consumers:     newConsumers(log),
+		subscriptions: make(map[string]*subscription),
+	}
+}
+
+// reloadOnSignal reloads the config every time the process gets a SIGHUP
+func (r *runner) reloadOnSignal(cmd *cobra.Command) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		r.log.Info("Got SIGHUP - reloading the configuration")
+		if err := r.reload(cmd); err != nil {
+			r.log.WithError(err).Error("Failed to reload the configuration - keeping the running one")
+			continue
+		}
+		r.log.Info("Reloaded the configuration")
+	}
+}
+
+// reload loads the config again and applies it, one reload at a time
+func (r *runner) reload(cmd *cobra.Command) error {
+	r.reloading.Lock()
+	defer r.reloading.Unlock()
+
+	config, err := conf.LoadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	return r.apply(config)
+}
+
+// apply makes the running subscriptions, batchers and connections match the
+// config. Subscriptions that stay keep their nats subscription and only get a
+// new handler, removed ones are drained before the batchers they send to are
+// flushed and stopped. Everything the config needs is started before anything
+// running is changed, so nothing running is touched if any of it fails.
+func (r *runner) apply(config *conf.Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if problems := config.Problems(); len(problems) > 0 {
+		msgs := make([]string, len(problems))
+		for i, p := range problems {
+			msgs[i] = p.String()
+		}
+		return fmt.Errorf("Invalid configuration: %s", strings.Join(msgs, "; "))
+	}
+
+	c := &change{
+		config:        config,
+		enricher:      r.enricher,
+		conns:         make(map[string]*connection),
+		subscriptions: make(map[string]*subscription),
+		updates:       make(map[string]*update),
+	}
+	if err := r.prepare(c); err != nil {
+		r.rollback(c)
+		return err
+	}
+	r.commit(c)
+	return nil
+}
+
+// change is what apply starts for a new config before it is committed
+type change struct {
+	config   *conf.Config
+	enricher *enrich.Enricher
+
+	conns  map[string]*connection
+	opened []*connection
+
+	// subscriptions are all the subscriptions of the config, the ones that are
+	// already running get their update on commit. The added ones are new.
+	subscriptions map[string]*subscription
+	updates       map[string]*update
+	added         []*subscription
+	subscribed    int
+}
+
+// update are the new settings of a running subscription
+type update struct {
+	pair    *conf.SubjectAndGroup
+	handler *handler
+	backlog chan<- messaging.Message
+}
+
+// prepare loads the enrichment, makes the new connections, starts the new
+// batchers and subscribes the new subscriptions. rollback undoes it.
+func (r *runner) prepare(c *change) error {
+	config := c.config
+	starting := r.config == nil
+	natsConfs, err := config.NatsConnections()
+	if err != nil {
+		return err
+	}
+
+	if starting || !reflect.DeepEqual(r.config.EnrichConf, config.EnrichConf) {
+		c.enricher = nil
+		if config.EnrichConf != nil {
+			r.log.Debug("Loading enrichment")
+			if c.enricher, err = enrich.NewEnricher(config.EnrichConf, Version, r.log); err != nil {
+				return fmt.Errorf("Failed to load enrichment: %v", err)
+			}
+		}
+	}
+
+	// connections are only made once a subject or the stats need them
+	names := []string{}
+	for i := range config.Subjects {
+		names = append(names, config.Subjects[i].ConnectionName())
+	}
+	if config.StatsConf != nil {
+		names = append(names, config.StatsConf.WithDefaults().Connection)
+	}
+
+	for _, name := range names {
+		if _, ok := c.conns[name]; ok {
+			continue
+		}
+
+		key, err := json.Marshal(natsConfs[name])
+		if err != nil {
+			return err
+		}
+		if existing, ok := r.conns[name]; ok && existing.key == string(key) {
+			c.conns[name] = existing
+			continue
+		}
+
+		conn, err := connect(name, natsConfs[name], r.subs, r.log)
+		if err != nil {
+			return fmt.Errorf("Failed to connect to nats '%s': %v", name, err)
+		}
+		c.conns[name] = conn
+		c.opened = append(c.opened, conn)
+	}
+
+	r.consumers.begin(config.BufferSize, config.ReportSec)
+	for i := range config.Subjects {
+		pair := &config.Subjects[i]
+		conn := c.conns[pair.ConnectionName()]
+		log := r.log.WithFields(logrus.Fields{
+			"subject":    pair.Subject,
+			"group":      pair.Group,
+			"connection": pair.ConnectionName(),
+		})
+
+		// connect ~ does it go to the default or a custom one?
+		endpoint, err := config.Endpoint(pair)
+		if err != nil {
+			return err
+		}
+		if pair.Endpoint == nil {
+			log.Debug("Using default consumer")
+		}
+		cons, err := r.consumers.get(endpoint)
+		if err != nil {
+			return fmt.Errorf("Failed to start consumer for %s: %v", pair.Subject, err)
+		}
+
+		key := subscriptionKey(conn, pair)
+		for n := 1; c.subscriptions[key] != nil; n++ {
+			key = fmt.Sprintf("%s#%d", subscriptionKey(conn, pair), n)
+		}
+
+		s, exists := r.subscriptions[key]
+		if !exists {
+			s = newSubscription(conn, pair, log)
+		}
+
+		handler, err := buildHandler(pair, cons, s.stats, c.enricher, log)
+		if err != nil {
+			return fmt.Errorf("Failed to build handler for %s: %v", pair.Subject, err)
+		}
+
+		if exists {
+			c.updates[key] = &update{pair: pair, handler: handler, backlog: cons}
+		} else {
+			s.swap(pair, handler, cons)
+			c.added = append(c.added, s)
+		}
+		c.subscriptions[key] = s
+	}
+
+	// the new subscriptions only start once everything they need is there
+	for _, s := range c.added {
+		if err := s.subscribe(r.subs); err != nil {
+			return fmt.Errorf("Failed to subscribe to %s: %v", s.settings().Subject, err)
+		}
+		c.subscribed++
+		s.log.Info("Started consuming from subject")
+	}
+	return nil
+}
+
+// rollback stops what prepare started, the running config is left as it was
+func (r *runner) rollback(c *change) {
+	for i, s := range c.added {
+		if i < c.subscribed {
+			s.drain(r.subs)
+		} else {
+			s.handler.close()
+		}
+	}
+	for _, u := range c.updates {
+		u.handler.close()
+	}
+
+	r.consumers.rollback()
+	for _, conn := range c.opened {
+		conn.retire()
+	}
+	if c.enricher != nil && c.enricher != r.enricher {
+		c.enricher.Close()
+	}
+}
+
+// commit switches the running subscriptions over to the prepared change and
+// stops what the config no longer uses
+func (r *runner) commit(c *change) {
+	config := c.config
+	if r.config != nil && !reflect.DeepEqual(r.config.LogConf, config.LogConf) {
+		if _, err := conf.ConfigureLogging(&config.LogConf); err != nil {
+			r.log.WithError(err).Warn("Failed to reconfigure logging")
+		}
+	}
+
+	for key, s := range c.subscriptions {
+		if u, ok := c.updates[key]; ok {
+			s.swap(u.pair, u.handler, u.backlog).close()
+			s.log.Debug("Updated the subscription")
+		}
+		s.startReporting(config.ReportSec)
+	}
+
+	// removed subscriptions have to be done sending before their batchers stop
+	wg := sync.WaitGroup{}
+	for key, s := range r.subscriptions {
+		if _, ok := c.subscriptions[key]; !ok {
+			wg.Add(1)
+			go func(s *subscription) {
+				defer wg.Done()
+				s.drain(r.subs)
+			}(s)
+		}
+	}
+	wg.Wait()
+	r.consumers.commit()
+	r.configurePublisher(config, c.conns)
+
+	for name, conn := range r.conns {
+		if c.conns[name] != conn {
+			conn.retire()
+		}
+	}
+	if r.enricher != nil && r.enricher != c.enricher {
+		r.enricher.Close()
+	}
+
+	r.config = config
+	r.conns = c.conns
+	r.enricher = c.enricher
+	r.subscriptions = c.subscriptions
+}
+
+// subscriptionKey identifies what the nats subscription of a subject depends
+// on, subjects with the same key can keep their subscription across a reload
+func subscriptionKey(conn *connection, pair *conf.SubjectAndGroup) string {
+	js, _ := json.Marshal(pair.JetStream)
+	return strings.Join([]string{conn.key, pair.Subject, pair.Group, string(js)}, "\x00")
+}
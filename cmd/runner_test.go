@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/elastinats/conf"
+	"github.com/netlify/elastinats/messaging"
+)
+
+var testLog = logrus.StandardLogger().WithField("testing", true)
+
+// testElastic accepts bulk requests and counts the documents by index
+type testElastic struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	docs map[string]int
+}
+
+func startTestElastic() *testElastic {
+	e := &testElastic{docs: make(map[string]int)}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		index := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")[0]
+
+		e.mu.Lock()
+		e.docs[index] += strings.Count(string(body), "\n") / 2
+		e.mu.Unlock()
+		w.Write([]byte(`{"errors": false}`))
+	}))
+	return e
+}
+
+func (e *testElastic) Docs(index string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.docs[index]
+}
+
+func (e *testElastic) endpoint(index string) *conf.ElasticConfig {
+	u, _ := url.Parse(e.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return &conf.ElasticConfig{
+		Index:           index,
+		Hosts:           []string{u.Hostname()},
+		Port:            port,
+		Type:            "log",
+		BatchSize:       1,
+		BatchTimeoutSec: 1,
+	}
+}
+
+func testConfig(server *testServer, es *testElastic, subjects ...conf.SubjectAndGroup) *conf.Config {
+	return &conf.Config{
+		NatsConf:    messaging.NatsConfig{Servers: []string{server.URL()}},
+		ElasticConf: es.endpoint("logs"),
+		Subjects:    subjects,
+		BufferSize:  10,
+	}
+}
+
+func publish(t *testing.T, server *testServer, subject, msg string) {
+	nc, err := nats.Connect(server.URL())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer nc.Close()
+	assert.Nil(t, nc.Publish(subject, []byte(msg)))
+	assert.Nil(t, nc.Flush())
+}
+
+func TestApplyAndReload(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	es := startTestElastic()
+	defer es.Close()
+
+	r := newRunner(testLog)
+	assert.Nil(t, r.apply(testConfig(server, es, conf.SubjectAndGroup{Subject: "logs"})))
+	eventually(t, "the subscription", func() bool { return server.Subscriptions("logs") == 1 })
+
+	publish(t, server, "logs", "first")
+	eventually(t, "the document", func() bool { return es.Docs("logs") == 1 })
+
+	// logs is removed, audit is added and sends to its own index
+	audit := conf.SubjectAndGroup{Subject: "audit", Endpoint: &conf.ElasticConfig{Index: "audit"}}
+	assert.Nil(t, r.apply(testConfig(server, es, audit)))
+	assert.Equal(t, 0, server.Subscriptions("logs"))
+	eventually(t, "the new subscription", func() bool { return server.Subscriptions("audit") == 1 })
+	assert.Len(t, r.subscriptions, 1)
+	assert.Len(t, r.consumers.byEndpoint, 1)
+
+	publish(t, server, "audit", "second")
+	eventually(t, "the audit document", func() bool { return es.Docs("audit") == 1 })
+	assert.Equal(t, 1, es.Docs("logs"))
+}
+
+func TestFailedReloadRollsBack(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	es := startTestElastic()
+	defer es.Close()
+
+	r := newRunner(testLog)
+	running := testConfig(server, es, conf.SubjectAndGroup{Subject: "logs"})
+	assert.Nil(t, r.apply(running))
+	eventually(t, "the subscription", func() bool { return server.Subscriptions("logs") == 1 })
+	assert.Equal(t, 1, server.Clients())
+
+	// there is no JetStream, so the last subject fails after the others are ready
+	broken := testConfig(server, es,
+		conf.SubjectAndGroup{Subject: "logs", Endpoint: &conf.ElasticConfig{Index: "moved"}},
+		conf.SubjectAndGroup{Subject: "audit", Endpoint: &conf.ElasticConfig{Index: "audit"}},
+		conf.SubjectAndGroup{
+			Subject:    "events",
+			Connection: "edge",
+			JetStream:  &messaging.JetStreamConfig{Stream: "EVENTS", Durable: "elastinats"},
+		},
+	)
+	broken.NatsConns = []conf.NatsConnection{{Name: "edge", NatsConfig: messaging.NatsConfig{Servers: []string{server.URL()}}}}
+	err := r.apply(broken)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Failed to subscribe to events")
+	}
+
+	assert.True(t, r.config == running)
+	assert.Len(t, r.subscriptions, 1)
+	assert.Len(t, r.consumers.byEndpoint, 1)
+	assert.Len(t, r.conns, 1)
+	eventually(t, "the new subscription to go away", func() bool { return server.Subscriptions("audit") == 0 })
+	eventually(t, "the new connection to close", func() bool { return server.Clients() == 1 })
+
+	// logs still sends to where it did
+	publish(t, server, "logs", "after")
+	eventually(t, "the document", func() bool { return es.Docs("logs") == 1 })
+	assert.Equal(t, 0, es.Docs("moved"))
+}
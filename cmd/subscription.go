@@ -0,0 +1,457 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nats-io/nats.go"
+
+	"github.com/netlify/elastinats/conf"
+	"github.com/netlify/elastinats/messaging"
+	"github.com/netlify/elastinats/stats"
+)
+
+const (
+	// how often a paused subscription checks if the backlog has drained
+	resumeCheckInterval = time.Second
+
+	// how long a removed subscription gets to handle what the client already received
+	drainTimeout = 30 * time.Second
+)
+
+// errNotConsuming is returned by subscribe when the subscription was stopped or
+// held while it was subscribing, the new nats subscription is dropped again
+var errNotConsuming = errors.New("The subscription was stopped or held while subscribing")
+
+// subscription keeps track of the nats subscription for a subject so that it
+// can be paused and resumed when it can't keep up, and so that its handler can
+// be swapped when the config is reloaded
+type subscription struct {
+	nc    *nats.Conn
+	conn  *connection
+	stats *stats.SubjectCounters
+	log   *logrus.Entry
+
+	handlerMu sync.RWMutex
+	handler   *handler
+
+	mu        sync.Mutex
+	pair      *conf.SubjectAndGroup
+	backlog   chan<- messaging.Message
+	sub       *nats.Subscription
+	paused    bool
+	held      bool
+	stopped   bool
+	reporting chan<- bool
+
+	// counted is how many of the messages the current nats subscription dropped
+	// are already in the counters of the subject
+	counted int
+
+	// seriesID tells the metrics of subscriptions apart that only differ in
+	// settings that aren't labels, e.g. the same subject listed twice
+	seriesID string
+}
+
+func newSubscription(conn *connection, pair *conf.SubjectAndGroup, log *logrus.Entry) *subscription {
+	return &subscription{
+		nc:       conn.nc,
+		conn:     conn,
+		pair:     pair,
+		stats:    stats.NewSubjectCounter(pair.Subject, pair.Group),
+		log:      log,
+		seriesID: nextSeriesID(),
+	}
+}
+
+// registry finds the subscription that a nats subscription belongs to
+type registry struct {
+	mu    sync.Mutex
+	bySub map[*nats.Subscription]*subscription
+}
+
+func newRegistry() *registry {
+	return &registry{bySub: make(map[*nats.Subscription]*subscription)}
+}
+
+func (r *registry) lookup(sub *nats.Subscription) *subscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bySub[sub]
+}
+
+func (r *registry) set(sub *nats.Subscription, s *subscription) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bySub[sub] = s
+}
+
+func (r *registry) remove(sub *nats.Subscription) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.bySub, sub)
+}
+
+// handle passes the message to the current handler. Swapping the handler waits
+// for the message that is being handled.
+func (s *subscription) handle(m *nats.Msg) {
+	s.handlerMu.RLock()
+	defer s.handlerMu.RUnlock()
+	s.handler.handle(m)
+}
+
+// swap starts using the new settings of the subject and returns the previous
+// handler, which is no longer called
+func (s *subscription) swap(pair *conf.SubjectAndGroup, h *handler, backlog chan<- messaging.Message) *handler {
+	s.handlerMu.Lock()
+	old := s.handler
+	s.handler = h
+	s.handlerMu.Unlock()
+
+	s.mu.Lock()
+	s.pair = pair
+	s.backlog = backlog
+	sub := s.sub
+	s.mu.Unlock()
+
+	if sub != nil {
+		msgs, bytes := pair.PendingLimits()
+		if err := sub.SetPendingLimits(msgs, bytes); err != nil {
+			s.log.WithError(err).Warn("Failed to update the pending limits")
+		}
+	}
+	return old
+}
+
+// subscribe ~ jetstream, queue or alone
+func (s *subscription) subscribe(subs *registry) error {
+	s.mu.Lock()
+	pair := s.pair
+	s.mu.Unlock()
+
+	var sub *nats.Subscription
+	var err error
+	switch {
+	case pair.JetStream != nil:
+		s.log.WithFields(logrus.Fields{
+			"stream":  pair.JetStream.Stream,
+			"durable": pair.JetStream.Durable,
+		}).Debug("Subscribing to JetStream")
+		sub, err = subscribeJetStream(s.nc, pair, s.handle)
+	case pair.Group == "":
+		s.log.Debug("Subscribing")
+		sub, err = s.nc.Subscribe(pair.Subject, s.handle)
+	default:
+		s.log.Debug("Subscribing to Queue")
+		sub, err = s.nc.QueueSubscribe(pair.Subject, pair.Group, s.handle)
+	}
+	if err != nil {
+		return err
+	}
+
+	msgs, bytes := pair.PendingLimits()
+	if err = sub.SetPendingLimits(msgs, bytes); err != nil {
+		sub.Unsubscribe()
+		return err
+	}
+
+	// drain or hold might have run while subscribing, they win
+	s.mu.Lock()
+	if s.stopped || s.held || s.sub != nil {
+		s.mu.Unlock()
+		sub.Unsubscribe()
+		return errNotConsuming
+	}
+	s.sub = sub
+	s.counted = 0
+	s.paused = false
+	s.mu.Unlock()
+	subs.set(sub, s)
+
+	return nil
+}
+
+// slowConsumer is called when nats reports that the pending limits were hit
+func (s *subscription) slowConsumer(subs *registry) {
+	s.stats.IncrementSlowConsumers()
+
+	s.mu.Lock()
+	if s.pair.SlowConsumerPolicy != conf.SlowConsumerPause || s.pair.JetStream != nil {
+		// the client drops the messages, they're counted here and whenever the
+		// subscription is reported on
+		if s.sub != nil {
+			s.countDropped()
+		}
+		s.mu.Unlock()
+		return
+	}
+	if s.paused || s.held || s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	sub := s.sub
+	s.sub = nil
+	s.paused = true
+	s.mu.Unlock()
+
+	s.log.Warn("Pausing the subscription until the backlog drained")
+	s.stats.IncrementPauses()
+	subs.remove(sub)
+
+	// draining keeps what the client already received, unsubscribing would drop it
+	if err := sub.Drain(); err != nil {
+		s.log.WithError(err).Warn("Failed to drain the subscription - unsubscribing")
+		sub.Unsubscribe()
+	}
+
+	go s.resumeWhenDrained(subs, sub)
+}
+
+// resumeWhenDrained waits until the previous subscription handled what it still
+// had and the backlog is at most half full, and subscribes again
+func (s *subscription) resumeWhenDrained(subs *registry, previous *nats.Subscription) {
+	ticks := time.NewTicker(resumeCheckInterval)
+	defer ticks.Stop()
+	for range ticks.C {
+		s.mu.Lock()
+		stopped, held, backlog := s.stopped, s.held, s.backlog
+		s.mu.Unlock()
+		if stopped {
+			return
+		}
+		if held || previous.IsValid() || len(backlog) > cap(backlog)/2 {
+			continue
+		}
+
+		if err := s.subscribe(subs); err != nil {
+			if err != errNotConsuming {
+				s.log.WithError(err).Warn("Failed to resume the subscription - will retry")
+			}
+			continue
+		}
+		s.log.Info("Resumed the subscription")
+		return
+	}
+}
+
+// hold stops consuming until release is called. Core nats subscriptions are
+// drained, it returns once what they already received is handled. JetStream
+// consumers are paused on the server so that they keep their place in the stream.
+func (s *subscription) hold(subs *registry) error {
+	s.mu.Lock()
+	if s.held || s.stopped {
+		s.mu.Unlock()
+		return nil
+	}
+	if js := s.pair.JetStream; js != nil {
+		s.mu.Unlock()
+		// paused for as long as it can be, until it is released
+		if err := js.Pause(s.nc, time.Now().AddDate(100, 0, 0)); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.held = true
+		s.mu.Unlock()
+		s.log.Info("Paused the JetStream consumer")
+		return nil
+	}
+
+	sub := s.sub
+	if sub != nil {
+		s.countDropped()
+	}
+	s.sub = nil
+	s.held = true
+	s.mu.Unlock()
+
+	// it is only held once what the client already received is handled
+	if sub != nil {
+		subs.remove(sub)
+		if err := drainAndWait(sub, drainTimeout); err != nil {
+			return err
+		}
+	}
+	s.log.Info("Held the subscription")
+	return nil
+}
+
+// release starts consuming again after hold, a subscription that was also paused
+// because it was too slow resumes once its backlog drained
+func (s *subscription) release(subs *registry) error {
+	s.mu.Lock()
+	if !s.held || s.stopped {
+		s.mu.Unlock()
+		return nil
+	}
+	js, paused := s.pair.JetStream, s.paused
+	if js == nil {
+		// subscribe doesn't consume while it is held, a paused one resumes by itself
+		s.held = false
+	}
+	s.mu.Unlock()
+
+	switch {
+	case js != nil:
+		if err := js.Pause(s.nc, time.Time{}); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.held = false
+		s.mu.Unlock()
+	case !paused:
+		if err := s.subscribe(subs); err != nil {
+			s.mu.Lock()
+			if !s.stopped {
+				s.held = true
+			}
+			s.mu.Unlock()
+			return err
+		}
+	}
+
+	s.log.Info("Released the subscription")
+	return nil
+}
+
+// The states of a subscription: paused is when it was too slow, held when it
+// was paused through the admin API
+const (
+	statusActive = "active"
+	statusPaused = "paused"
+	statusHeld   = "held"
+	statusClosed = "closed"
+)
+
+func (s *subscription) status() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.held:
+		return statusHeld
+	case s.paused:
+		return statusPaused
+	case s.sub == nil || !s.sub.IsValid():
+		return statusClosed
+	}
+	return statusActive
+}
+
+// settings are the current settings of the subject
+func (s *subscription) settings() *conf.SubjectAndGroup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pair
+}
+
+// startReporting (re)starts the periodic stats report of the subscription
+func (s *subscription) startReporting(reportSec int64) {
+	reporting := s.stats.StartReporting(reportSec, s.nc, s.conn.stats, s, s.log)
+
+	s.mu.Lock()
+	previous := s.reporting
+	s.reporting = reporting
+	s.mu.Unlock()
+
+	if previous != nil {
+		close(previous)
+	}
+}
+
+// drain stops the subscription after the messages that the client already
+// received are handled, and sends on what the handler is still holding on to
+func (s *subscription) drain(subs *registry) {
+	s.mu.Lock()
+	sub := s.sub
+	if sub != nil {
+		s.countDropped()
+	}
+	s.sub = nil
+	s.stopped = true
+	reporting := s.reporting
+	s.reporting = nil
+	s.mu.Unlock()
+
+	if reporting != nil {
+		close(reporting)
+	}
+
+	if sub != nil {
+		s.log.Info("Draining the subscription")
+		if err := drainAndWait(sub, drainTimeout); err != nil {
+			s.log.WithError(err).Warn("Failed to drain the subscription")
+		}
+		subs.remove(sub)
+	}
+
+	s.handlerMu.Lock()
+	s.handler.close()
+	s.handlerMu.Unlock()
+	s.log.Info("Stopped consuming from subject")
+}
+
+// drainAndWait stops the nats subscription once the messages that the client
+// already received are handled. It unsubscribes, dropping what is left, if that
+// fails or takes longer than the timeout.
+func drainAndWait(sub *nats.Subscription, timeout time.Duration) error {
+	if err := sub.Drain(); err != nil {
+		sub.Unsubscribe()
+		return fmt.Errorf("Failed to drain the subscription - unsubscribed: %v", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for sub.IsValid() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sub.IsValid() {
+		sub.Unsubscribe()
+		return fmt.Errorf("Timed out draining the subscription after %s - unsubscribed", timeout)
+	}
+	return nil
+}
+
+// Pending, Delivered and Dropped report on the current nats subscription, they
+// are all 0 while it is paused. Dropped also counts the messages that were
+// dropped since it was last called for the subject.
+
+func (s *subscription) Pending() (int, int, error) {
+	if sub := s.current(); sub != nil {
+		return sub.Pending()
+	}
+	return 0, 0, nil
+}
+
+func (s *subscription) Delivered() (int64, error) {
+	if sub := s.current(); sub != nil {
+		return sub.Delivered()
+	}
+	return 0, nil
+}
+
+func (s *subscription) Dropped() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sub == nil {
+		return 0, nil
+	}
+	return s.countDropped()
+}
+
+// countDropped adds what the current nats subscription dropped since it was last
+// counted to the counters of the subject, the caller holds the lock
+func (s *subscription) countDropped() (int, error) {
+	dropped, err := s.sub.Dropped()
+	if err == nil && dropped > s.counted {
+		s.stats.AddMessagesDropped(int64(dropped - s.counted))
+		s.counted = dropped
+	}
+	return dropped, err
+}
+
+func (s *subscription) current() *nats.Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sub
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/elastinats/conf"
+	"github.com/netlify/elastinats/messaging"
+)
+
+// blockedSubscription is subscribed with a handler that waits for release, so
+// that the messages pile up in the client
+func blockedSubscription(t *testing.T, server *testServer, pair *conf.SubjectAndGroup) (*subscription, *registry, chan bool, *int64) {
+	subs := newRegistry()
+	conn, err := connect(conf.DefaultConnection, &messaging.NatsConfig{Servers: []string{server.URL()}}, subs, testLog)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	handled := new(int64)
+	release := make(chan bool)
+	s := newSubscription(conn, pair, testLog)
+	s.swap(pair, &handler{handle: func(*nats.Msg) {
+		<-release
+		atomic.AddInt64(handled, 1)
+	}}, make(chan messaging.Message, 10))
+	if err := s.subscribe(subs); err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	eventually(t, "the subscription", func() bool { return server.Subscriptions(pair.Subject) == 1 })
+	return s, subs, release, handled
+}
+
+func TestSlowConsumerPauseKeepsPending(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+
+	pair := &conf.SubjectAndGroup{Subject: "logs", SlowConsumerPolicy: conf.SlowConsumerPause}
+	s, subs, release, handled := blockedSubscription(t, server, pair)
+	defer s.drain(subs)
+
+	for i := 0; i < 3; i++ {
+		publish(t, server, "logs", "line")
+	}
+	eventually(t, "the messages to be pending", func() bool {
+		msgs, _, _ := s.Pending()
+		return msgs >= 2
+	})
+
+	s.slowConsumer(subs)
+	assert.Equal(t, statusPaused, s.status())
+	close(release)
+
+	eventually(t, "the pending messages", func() bool { return atomic.LoadInt64(handled) == 3 })
+	eventually(t, "the subscription to resume", func() bool { return s.status() == statusActive })
+}
+
+func TestHoldWaitsForPending(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+
+	s, subs, release, handled := blockedSubscription(t, server, &conf.SubjectAndGroup{Subject: "logs"})
+	defer s.drain(subs)
+
+	for i := 0; i < 3; i++ {
+		publish(t, server, "logs", "line")
+	}
+
+	held := make(chan error)
+	go func() {
+		held <- s.hold(subs)
+	}()
+	select {
+	case <-held:
+		assert.FailNow(t, "held before the pending messages were handled")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Nil(t, <-held)
+	assert.EqualValues(t, 3, atomic.LoadInt64(handled))
+	assert.Equal(t, statusHeld, s.status())
+	assert.Equal(t, 0, server.Subscriptions("logs"))
+
+	assert.Nil(t, s.release(subs))
+	assert.Equal(t, statusActive, s.status())
+}
+
+func TestDroppedMessagesAreCounted(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+
+	pair := &conf.SubjectAndGroup{Subject: "logs", PendingMsgsLimit: 1}
+	s, subs, release, _ := blockedSubscription(t, server, pair)
+	defer s.drain(subs)
+	defer close(release)
+
+	// the message being handled is still pending, so the rest is dropped
+	publish(t, server, "logs", "handled")
+	eventually(t, "the message to be handled", func() bool {
+		delivered, _ := s.Delivered()
+		return delivered == 1
+	})
+	for i := 0; i < 4; i++ {
+		publish(t, server, "logs", "line")
+	}
+	eventually(t, "the messages to be dropped", func() bool {
+		dropped, _ := s.Dropped()
+		return dropped == 4
+	})
+
+	// reading it again doesn't count them again
+	s.Dropped()
+	assert.EqualValues(t, 1, s.stats.Snapshot().SlowConsumers)
+	assert.EqualValues(t, 4, s.stats.Snapshot().MessagesDropped)
+}
+
+func TestNoSubscribeAfterDrainOrHold(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+
+	s, subs, release, _ := blockedSubscription(t, server, &conf.SubjectAndGroup{Subject: "logs"})
+	close(release)
+
+	// like a resume that raced with hold and then drain
+	assert.Nil(t, s.hold(subs))
+	assert.Equal(t, errNotConsuming, s.subscribe(subs))
+	assert.Equal(t, statusHeld, s.status())
+	eventually(t, "the subscriptions to go", func() bool { return server.Subscriptions("logs") == 0 })
+
+	s.drain(subs)
+	assert.Equal(t, errNotConsuming, s.subscribe(subs))
+	assert.Nil(t, s.current())
+	eventually(t, "the subscriptions to go", func() bool { return server.Subscriptions("logs") == 0 })
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/netlify/elastinats/conf"
+	"github.com/netlify/elastinats/enrich"
+	"github.com/netlify/elastinats/messaging"
+)
+
+var validateCmd = &cobra.Command{
+	Run:   validate,
+	Use:   "validate",
+	Short: "check the configuration and exit",
+	Long:  "check every setting of the configuration, and optionally that nats and elasticsearch can be reached, then print all the problems found",
+}
+
+func init() {
+	validateCmd.Flags().Bool("connect", false, "also connect to nats and elasticsearch")
+}
+
+func validate(cmd *cobra.Command, _ []string) {
+	config, err := conf.LoadConfig(cmd)
+	if err != nil {
+		fmt.Printf("Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	problems := config.Problems()
+
+	if config.EnrichConf != nil {
+		// this loads the lookup tables and geoip databases
+		logger := logrus.New()
+		logger.Out = ioutil.Discard
+		enricher, err := enrich.NewEnricher(config.EnrichConf, Version, logrus.NewEntry(logger))
+		if err != nil {
+			problems = append(problems, conf.Problem{Path: "enrich_conf", Err: err})
+		} else {
+			enricher.Close()
+		}
+	}
+
+	if connect, _ := cmd.Flags().GetBool("connect"); connect && len(problems) == 0 {
+		problems = append(problems, checkConnectivity(config)...)
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("The configuration is valid")
+		return
+	}
+
+	for _, p := range problems {
+		fmt.Println(p.String())
+	}
+	fmt.Printf("Found %d problem(s)\n", len(problems))
+	os.Exit(1)
+}
+
+// checkConnectivity connects to every nats connection and elasticsearch host
+// that a subject uses, and checks that the JetStream streams exist
+func checkConnectivity(config *conf.Config) []conf.Problem {
+	problems := []conf.Problem{}
+
+	natsConfs, err := config.NatsConnections()
+	if err != nil {
+		return append(problems, conf.Problem{Path: "nats_conns", Err: err})
+	}
+
+	checkedConns := make(map[string]bool)
+	checkedHosts := make(map[string]bool)
+	for i := range config.Subjects {
+		pair := &config.Subjects[i]
+		path := fmt.Sprintf("subjects[%d]", i)
+
+		name := pair.ConnectionName()
+		if !checkedConns[name] {
+			checkedConns[name] = true
+			if err := checkNats(natsConfs[name], config.Subjects, name); err != nil {
+				problems = append(problems, conf.Problem{Path: connectionPath(name), Err: err})
+			}
+		}
+
+		endpoint, err := config.Endpoint(pair)
+		if err != nil {
+			continue
+		}
+		for _, host := range endpoint.Hosts {
+			url := fmt.Sprintf("http://%s:%d/", host, endpoint.Port)
+			if checkedHosts[url] {
+				continue
+			}
+			checkedHosts[url] = true
+			if err := checkElasticsearch(url, endpoint); err != nil {
+				problems = append(problems, conf.Problem{Path: path + ".elastic_conf.hosts", Err: err})
+			}
+		}
+	}
+
+	return problems
+}
+
+func connectionPath(name string) string {
+	if name == conf.DefaultConnection {
+		return "nats_conf"
+	}
+	return fmt.Sprintf("nats_conns[%s]", name)
+}
+
+func checkNats(config *messaging.NatsConfig, subjects []conf.SubjectAndGroup, name string) error {
+	nc, err := messaging.ConnectToNats(config, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to %s: %v", config.ServerString(), err)
+	}
+	defer nc.Close()
+
+	for _, pair := range subjects {
+		if pair.JetStream == nil || pair.ConnectionName() != name {
+			continue
+		}
+
+		js, err := nc.JetStream()
+		if err != nil {
+			return err
+		}
+		if _, err := js.StreamInfo(pair.JetStream.Stream); err != nil {
+			return fmt.Errorf("Failed to find JetStream stream '%s': %v", pair.JetStream.Stream, err)
+		}
+	}
+	return nil
+}
+
+func checkElasticsearch(url string, endpoint *conf.ElasticConfig) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	endpoint.Authorize(req)
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to reach elasticsearch at %s: %v", url, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Elasticsearch at %s responded with %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -3,6 +3,9 @@ package conf
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
 	"strings"
 	"text/template"
 	"time"
@@ -12,69 +15,426 @@ import (
 
 	"os"
 
+	"github.com/netlify/elastinats/enrich"
 	"github.com/netlify/elastinats/messaging"
 )
 
 type Config struct {
-	NatsConf    messaging.NatsConfig `mapstructure:"nats_conf"    json:"nats_conf"`
-	ElasticConf *ElasticConfig       `mapstructure:"elastic_conf" json:"elastic_conf"`
-	LogConf     LoggingConfig        `mapstructure:"log_conf"     json:"log_conf"`
-	Subjects    []SubjectAndGroup    `mapstructure:"subjects"     json:"subjects"`
-	ReportSec   int64                `mapstructure:"report_sec"   json:"report_sec"`
-	BufferSize  int64                `mapstructure:"buffer_size"  json:"buffer_size"`
+	NatsConf    messaging.NatsConfig `mapstructure:"nats_conf"    json:"nats_conf"    desc:"The default nats connection"`
+	ElasticConf *ElasticConfig       `mapstructure:"elastic_conf" json:"elastic_conf" desc:"The default elasticsearch endpoint, subjects fill in what they don't set from it"`
+	LogConf     LoggingConfig        `mapstructure:"log_conf"     json:"log_conf"     desc:"Where and what to log"`
+	Subjects    []SubjectAndGroup    `mapstructure:"subjects"     json:"subjects"     desc:"The subjects to consume and where to index them"`
+	ReportSec   int64                `mapstructure:"report_sec"   json:"report_sec"   desc:"How often the stats are logged in seconds, 0 disables the reports"`
+	BufferSize  int64                `mapstructure:"buffer_size"  json:"buffer_size"  desc:"How many messages are buffered for each batcher"`
+	EnrichConf  *enrich.Config       `mapstructure:"enrich_conf"  json:"enrich_conf"  desc:"Fields that are added to every payload"`
+
+	// NatsConns are extra named connections that subjects can refer to, the
+	// NatsConf is the 'default' connection
+	NatsConns []NatsConnection `mapstructure:"nats_conns" json:"nats_conns" desc:"Extra named nats connections that subjects can use"`
+
+	// WatchConfigSec is how often the config file is checked for changes, which
+	// are applied like on a SIGHUP. 0 disables watching.
+	WatchConfigSec int64 `mapstructure:"watch_config_sec" json:"watch_config_sec" desc:"How often the config file is checked for changes in seconds, 0 disables watching"`
+
+	// AdminConf starts an HTTP listener for the admin endpoints
+	AdminConf *AdminConfig `mapstructure:"admin_conf" json:"admin_conf" desc:"The HTTP listener for the admin endpoints"`
+
+	// StatsConf publishes the stats to nats as JSON
+	StatsConf *StatsConfig `mapstructure:"stats_conf" json:"stats_conf" desc:"Publishes the stats to nats as JSON"`
+}
+
+// StatsConfig publishes a stats document every report_sec and answers requests for it
+type StatsConfig struct {
+	// Subject is where the reports are published, '{hostname}' is replaced with
+	// the hostname with its dots replaced by underscores
+	Subject        string `mapstructure:"subject"         json:"subject"         desc:"Where the reports are published, {hostname} is replaced with the hostname" default:"elastinats.stats.{hostname}"`
+	RequestSubject string `mapstructure:"request_subject" json:"request_subject" desc:"Requests on this subject are answered with the current stats" default:"elastinats.stats.request"`
+	Connection     string `mapstructure:"connection"      json:"connection"      desc:"The name of the nats connection to publish on" default:"default"`
+}
+
+const (
+	defaultStatsSubject        = "elastinats.stats.{hostname}"
+	defaultStatsRequestSubject = "elastinats.stats.request"
+)
+
+// WithDefaults returns the config with the defaults filled in
+func (s StatsConfig) WithDefaults() StatsConfig {
+	if s.Subject == "" {
+		s.Subject = defaultStatsSubject
+	}
+	if s.RequestSubject == "" {
+		s.RequestSubject = defaultStatsRequestSubject
+	}
+	if s.Connection == "" {
+		s.Connection = DefaultConnection
+	}
+	return s
+}
+
+// PublishSubject is the subject the reports of this host are published on
+func (s StatsConfig) PublishSubject(hostname string) string {
+	return strings.Replace(s.WithDefaults().Subject, "{hostname}", strings.Replace(hostname, ".", "_", -1), -1)
+}
+
+// Validate checks that the subjects can be published and subscribed to
+func (s StatsConfig) Validate() error {
+	s = s.WithDefaults()
+	if strings.ContainsAny(s.Subject, "*> \t") {
+		return fmt.Errorf("The stats subject '%s' can't have wildcards or spaces", s.Subject)
+	}
+	if strings.ContainsAny(s.RequestSubject, " \t") {
+		return fmt.Errorf("The stats request subject '%s' can't have spaces", s.RequestSubject)
+	}
+	return nil
+}
+
+// AdminConfig is the HTTP listener for the admin endpoints
+type AdminConfig struct {
+	// Listen is the address to listen on, e.g. ':9090'
+	Listen string `mapstructure:"listen" json:"listen" desc:"The address to listen on, e.g. ':9090'"`
+
+	// ReadyBulkSec is how long the bulk requests of an endpoint can keep failing
+	// before it isn't ready, ReadyBufferPercent how full its buffer can get
+	ReadyBulkSec       int `mapstructure:"ready_bulk_sec"       json:"ready_bulk_sec"       desc:"How long the bulk requests of an endpoint can fail before /readyz fails, in seconds" default:"120"`
+	ReadyBufferPercent int `mapstructure:"ready_buffer_percent" json:"ready_buffer_percent" desc:"How full the buffer of an endpoint can be before /readyz fails, in percent" default:"90"`
+
+	// Token has to be sent as a bearer token to use the admin API, which is
+	// disabled without it
+	Token string `mapstructure:"token" json:"token" secret:"true" desc:"The bearer token for the admin API, it is disabled without one"`
+}
+
+const (
+	defaultReadyBulkSec       = 120
+	defaultReadyBufferPercent = 90
+)
+
+// ReadyThresholds returns how long the bulk requests can fail and how full the
+// buffers can be for the process to be ready, the defaults if there is no config
+func (a *AdminConfig) ReadyThresholds() (time.Duration, int) {
+	var bulkSec, bufferPercent int
+	if a != nil {
+		bulkSec, bufferPercent = a.ReadyBulkSec, a.ReadyBufferPercent
+	}
+	if bulkSec == 0 {
+		bulkSec = defaultReadyBulkSec
+	}
+	if bufferPercent == 0 {
+		bufferPercent = defaultReadyBufferPercent
+	}
+	return time.Duration(bulkSec) * time.Second, bufferPercent
+}
+
+// DefaultConnection is the name of the connection configured in nats_conf
+const DefaultConnection = "default"
+
+// NatsConnection is a nats connection that subjects can refer to by name
+type NatsConnection struct {
+	Name                 string `mapstructure:"name" json:"name" desc:"The name subjects use to refer to the connection"`
+	messaging.NatsConfig `mapstructure:",squash"`
+}
+
+// NatsConnections returns the config for every connection by name
+func (c *Config) NatsConnections() (map[string]*messaging.NatsConfig, error) {
+	conns := map[string]*messaging.NatsConfig{
+		DefaultConnection: &c.NatsConf,
+	}
+
+	for i := range c.NatsConns {
+		conn := &c.NatsConns[i]
+		if conn.Name == "" {
+			return nil, fmt.Errorf("The nats connection at position %d is missing a name", i)
+		}
+		if conn.Name == DefaultConnection {
+			return nil, fmt.Errorf("The nats connection name '%s' is reserved for nats_conf", DefaultConnection)
+		}
+		if _, exists := conns[conn.Name]; exists {
+			return nil, fmt.Errorf("There is more than one nats connection named '%s'", conn.Name)
+		}
+		conns[conn.Name] = &conn.NatsConfig
+	}
+
+	return conns, nil
 }
 
 type SubjectAndGroup struct {
-	Subject  string         `mapstructure:"subject"      json:"subject"`
-	Group    string         `mapstructure:"group"        json:"group"`
-	Endpoint *ElasticConfig `mapstructure:"elastic_conf" json:"endpoint"`
+	Subject     string                   `mapstructure:"subject"      json:"subject"      desc:"The nats subject, wildcards are allowed"`
+	Group       string                   `mapstructure:"group"        json:"group"        desc:"The queue group, messages are shared with the other members"`
+	Endpoint    *ElasticConfig           `mapstructure:"elastic_conf" json:"elastic_conf" desc:"The endpoint for the subject, what isn't set is taken from the default elastic_conf"`
+	PayloadConf *messaging.PayloadConfig `mapstructure:"payload_conf" json:"payload_conf" desc:"How the payloads are reshaped before they are indexed"`
+
+	// Connection is the name of the nats connection to subscribe on, defaults to 'default'
+	Connection string `mapstructure:"connection" json:"connection" desc:"The name of the nats connection to subscribe on" default:"default"`
+
+	// SubjectFields is a pattern like 'logs.{env}.{service}.*' that copies tokens
+	// of the subject into the payload, see messaging.SubjectMapping
+	SubjectFields string `mapstructure:"subject_fields" json:"subject_fields" desc:"A pattern like 'logs.{env}.{service}.*' that copies tokens of the subject into the payload"`
+
+	// Multiline joins continuation lines like stack traces onto the previous message
+	Multiline *messaging.MultilineConfig `mapstructure:"multiline" json:"multiline" desc:"Joins continuation lines like stack traces onto the previous message"`
+
+	// JetStream consumes from a durable JetStream consumer and only acks messages once they're indexed
+	JetStream *messaging.JetStreamConfig `mapstructure:"jetstream" json:"jetstream" desc:"Consume from a durable JetStream consumer and ack messages once they're indexed"`
+
+	// Headers copies the nats headers of the message into the payload
+	Headers *messaging.HeadersConfig `mapstructure:"headers" json:"headers" desc:"Copies the nats headers of the message into the payload"`
+
+	// ReplyAck responds to messages with a reply subject once the document was
+	// indexed, with its id, index and whether it succeeded
+	ReplyAck bool `mapstructure:"reply_ack" json:"reply_ack" desc:"Reply to messages with a reply subject once they are indexed"`
+
+	// PendingMsgsLimit and PendingBytesLimit bound what the nats client buffers
+	// for the subscription. 0 and -1 mean no limit, like before they could be set.
+	PendingMsgsLimit  int `mapstructure:"pending_msgs_limit"  json:"pending_msgs_limit"  desc:"How many messages the nats client buffers for the subscription, -1 means no limit" default:"-1"`
+	PendingBytesLimit int `mapstructure:"pending_bytes_limit" json:"pending_bytes_limit" desc:"How many bytes the nats client buffers for the subscription, -1 means no limit" default:"-1"`
+
+	// SlowConsumerPolicy is what happens when the pending limits are hit: 'drop'
+	// (the default) drops and counts the messages, 'pause' unsubscribes until the
+	// backlog has drained.
+	SlowConsumerPolicy string `mapstructure:"slow_consumer_policy" json:"slow_consumer_policy" desc:"What happens when the pending limits are hit" default:"drop" enum:"drop,pause"`
+}
+
+const (
+	SlowConsumerDrop  = "drop"
+	SlowConsumerPause = "pause"
+)
+
+// Validate checks the settings of the subscription
+func (s *SubjectAndGroup) Validate() error {
+	switch s.SlowConsumerPolicy {
+	case "", SlowConsumerDrop, SlowConsumerPause:
+	default:
+		return fmt.Errorf("Unknown slow_consumer_policy '%s' - it must be '%s' or '%s'", s.SlowConsumerPolicy, SlowConsumerDrop, SlowConsumerPause)
+	}
+
+	if s.ReplyAck && s.JetStream != nil {
+		return errors.New("reply_ack can't be used with jetstream - the reply subject is used for the JetStream acks")
+	}
+	return nil
+}
+
+// ConnectionName is the name of the nats connection to subscribe on
+func (s *SubjectAndGroup) ConnectionName() string {
+	if s.Connection == "" {
+		return DefaultConnection
+	}
+	return s.Connection
+}
+
+// PendingLimits returns the limits to set on the subscription
+func (s *SubjectAndGroup) PendingLimits() (int, int) {
+	msgs, bytes := s.PendingMsgsLimit, s.PendingBytesLimit
+	if msgs == 0 {
+		msgs = -1
+	}
+	if bytes == 0 {
+		bytes = -1
+	}
+	return msgs, bytes
 }
 
 type ElasticConfig struct {
-	Index           string   `mapstructure:"index"             json:"index"`
-	Hosts           []string `mapstructure:"hosts"             json:"hosts"`
-	Port            int      `mapstructure:"port"              json:"port"`
-	Type            string   `mapstructure:"type"              json:"type"`
-	BatchSize       int      `mapstructure:"batch_size"        json:"batch_size"`
-	BatchTimeoutSec int      `mapstructure:"batch_timeout_sec" json:"batch_timeout_sec"`
-	BufferSize      int      `mapstructure:"buffer_size"       json:"buffer_size"`
-	indexTemplate   *template.Template
+	Index           string   `mapstructure:"index"             json:"index"             desc:"The index to write to, a template like 'logs-{{.Year}}'"`
+	Hosts           []string `mapstructure:"hosts"             json:"hosts"             desc:"The elasticsearch hosts"`
+	Port            int      `mapstructure:"port"              json:"port"              desc:"The port of the hosts"`
+	Type            string   `mapstructure:"type"              json:"type"              desc:"The document type"`
+	BatchSize       int      `mapstructure:"batch_size"        json:"batch_size"        desc:"How many documents are sent in one bulk request"`
+	BatchTimeoutSec int      `mapstructure:"batch_timeout_sec" json:"batch_timeout_sec" desc:"How long a batch waits to fill up before it is sent, in seconds"`
+	BufferSize      int      `mapstructure:"buffer_size"       json:"buffer_size"       desc:"Unused, the buffer is set with the top level buffer_size"`
+
+	// User and Password use basic auth, APIKey an elasticsearch API key
+	User     string `mapstructure:"user"     json:"user"     desc:"The user for basic auth"`
+	Password string `mapstructure:"password" json:"password" secret:"true" desc:"The password for basic auth"`
+	APIKey   string `mapstructure:"api_key"  json:"api_key"  secret:"true" desc:"An elasticsearch API key, instead of basic auth"`
+
+	// indexTemplate is parsed from indexParsed, which is the Index it was parsed from
+	indexTemplate *template.Template
+	indexParsed   string
+}
+
+// Merge returns the endpoint with everything that isn't set taken from the defaults,
+// so that a subject only has to configure what is different for it
+func (e *ElasticConfig) Merge(defaults *ElasticConfig) *ElasticConfig {
+	merged := *e
+	merged.indexTemplate = nil
+	if defaults == nil {
+		return &merged
+	}
+
+	if merged.Index == "" {
+		merged.Index = defaults.Index
+	}
+	if len(merged.Hosts) == 0 {
+		merged.Hosts = defaults.Hosts
+	}
+	if merged.Port == 0 {
+		merged.Port = defaults.Port
+	}
+	if merged.Type == "" {
+		merged.Type = defaults.Type
+	}
+	if merged.BatchSize == 0 {
+		merged.BatchSize = defaults.BatchSize
+	}
+	if merged.BatchTimeoutSec == 0 {
+		merged.BatchTimeoutSec = defaults.BatchTimeoutSec
+	}
+	if merged.BufferSize == 0 {
+		merged.BufferSize = defaults.BufferSize
+	}
+	// the credentials of the default cluster aren't sent to other hosts
+	if merged.User == "" && merged.APIKey == "" && len(e.Hosts) == 0 {
+		merged.User = defaults.User
+		merged.Password = defaults.Password
+		merged.APIKey = defaults.APIKey
+	}
+	return &merged
+}
+
+// Validate checks that the endpoint can be sent to and that the index template parses
+func (e *ElasticConfig) Validate() error {
+	switch {
+	case e.Index == "":
+		return errors.New("An index is required")
+	case len(e.Hosts) == 0:
+		return errors.New("At least one host is required")
+	case e.Port <= 0 || e.Port > 65535:
+		return fmt.Errorf("The port %d is invalid", e.Port)
+	case e.Type == "":
+		return errors.New("A type is required")
+	case e.BatchSize <= 0:
+		return fmt.Errorf("The batch_size must be positive, not %d", e.BatchSize)
+	case e.BatchTimeoutSec <= 0:
+		return fmt.Errorf("The batch_timeout_sec must be positive, not %d", e.BatchTimeoutSec)
+	case e.User != "" && e.Password == "":
+		return errors.New("user is set without a password")
+	case e.Password != "" && e.User == "":
+		return errors.New("password is set without a user")
+	case e.User != "" && e.APIKey != "":
+		return errors.New("Only one of user/password and api_key can be used")
+	}
+
+	// parsed only when the index changed, so that the batchers of a running
+	// endpoint only ever read it
+	if e.indexTemplate == nil || e.indexParsed != e.Index {
+		tmpl, err := parseIndex(e.Index)
+		if err != nil {
+			return fmt.Errorf("The index template is invalid: %v", err)
+		}
+		e.indexTemplate, e.indexParsed = tmpl, e.Index
+	}
+	return nil
+}
+
+// parseIndex parses the index template, a field that is missing from the payload
+// fails instead of becoming '<no value>'
+func parseIndex(index string) (*template.Template, error) {
+	return template.New("index_template").Option("missingkey=error").Parse(index)
+}
+
+// Endpoint returns the validated elasticsearch config the subject sends to: its own
+// elastic_conf merged onto the default one, or the default if it has none
+func (c *Config) Endpoint(s *SubjectAndGroup) (*ElasticConfig, error) {
+	var endpoint *ElasticConfig
+	switch {
+	case s.Endpoint != nil:
+		endpoint = s.Endpoint.Merge(c.ElasticConf)
+	case c.ElasticConf != nil:
+		endpoint = c.ElasticConf
+	default:
+		return nil, errors.New("No consumer provided and there is no default handler")
+	}
+
+	if err := endpoint.Validate(); err != nil {
+		return nil, err
+	}
+	return endpoint, nil
 }
 
-func (e *ElasticConfig) GetIndex(t time.Time) (string, error) {
+// Authorize adds the credentials of the endpoint to the request
+func (e *ElasticConfig) Authorize(req *http.Request) {
+	switch {
+	case e.User != "":
+		req.SetBasicAuth(e.User, e.Password)
+	case e.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+e.APIKey)
+	}
+}
+
+// indexData is what the index template is executed with. The methods of the time
+// are available directly ({{.Year}}) and the payload through {{.Fields.name}}
+type indexData struct {
+	time.Time
+	Fields messaging.Payload
+}
+
+func (e *ElasticConfig) GetIndex(t time.Time, fields messaging.Payload) (string, error) {
 	if e.Index == "" {
 		return "", errors.New("No index configured")
 	}
 
-	if e.indexTemplate == nil {
+	// an endpoint that wasn't validated parses it every time
+	tmpl := e.indexTemplate
+	if tmpl == nil || e.indexParsed != e.Index {
 		var err error
-		e.indexTemplate, err = template.New("index_template").Parse(e.Index)
-		if err != nil {
+		if tmpl, err = parseIndex(e.Index); err != nil {
 			return "", err
 		}
 	}
 
 	b := bytes.NewBufferString("")
-	err := e.indexTemplate.Execute(b, t)
+	if err := tmpl.Execute(b, indexData{Time: t, Fields: fields}); err != nil {
+		return "", err
+	}
 
-	return strings.ToLower(b.String()), err
+	index := strings.ToLower(b.String())
+	if strings.Contains(index, "<no value>") {
+		return "", fmt.Errorf("The index template '%s' has no value for a field", e.Index)
+	}
+	if err := checkIndexName(index); err != nil {
+		return "", err
+	}
+	return index, nil
+}
+
+// checkIndexName applies the elasticsearch rules for index names. The fields of a
+// payload end up in the path of the bulk request, so they can't be trusted.
+func checkIndexName(index string) error {
+	switch {
+	case index == "":
+		return errors.New("The index is empty")
+	case index == "." || index == "..":
+		return fmt.Errorf("The index can't be '%s'", index)
+	case len(index) > 255:
+		return fmt.Errorf("The index is longer than 255 bytes: %d", len(index))
+	case strings.IndexAny(index[:1], "-_+") == 0:
+		return fmt.Errorf("The index '%s' can't start with '-', '_' or '+'", index)
+	case strings.ContainsAny(index, "/\\*?\"<>|,#: \t\r\n"):
+		return fmt.Errorf("The index '%s' has a character that isn't allowed", index)
+	}
+	return nil
 }
 
 // LoadConfig loads the config from a file if specified, otherwise from the environment
 func LoadConfig(cmd *cobra.Command) (*Config, error) {
-	viper.SetConfigType("json")
-
 	err := viper.BindPFlags(cmd.Flags())
 	if err != nil {
 		return nil, err
 	}
 
-	viper.SetEnvPrefix("ELASTINATS")
+	viper.SetEnvPrefix(envPrefix)
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 
 	if configFile, _ := cmd.Flags().GetString("config"); configFile != "" {
 		viper.SetConfigFile(configFile)
+
+		// the format comes from the extension, anything else is json
+		switch ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(configFile)), "."); ext {
+		case "json", "yaml", "yml", "toml":
+			viper.SetConfigType(ext)
+		default:
+			viper.SetConfigType("json")
+		}
 	} else {
 		viper.SetConfigName("config")
 		viper.AddConfigPath("./")
@@ -87,9 +447,9 @@ func LoadConfig(cmd *cobra.Command) (*Config, error) {
 
 	config := new(Config)
 
-	if err := viper.Unmarshal(config); err != nil {
+	if err := viper.Unmarshal(config, viper.DecodeHook(interpolate)); err != nil {
 		return nil, err
 	}
 
-	return config, nil
+	return populateConfig(config)
 }
@@ -0,0 +1,216 @@
+package conf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/elastinats/messaging"
+)
+
+func TestPendingLimits(t *testing.T) {
+	msgs, bytes := (&SubjectAndGroup{}).PendingLimits()
+	assert.Equal(t, -1, msgs)
+	assert.Equal(t, -1, bytes)
+
+	msgs, bytes = (&SubjectAndGroup{PendingBytesLimit: 1024}).PendingLimits()
+	assert.Equal(t, -1, msgs)
+	assert.Equal(t, 1024, bytes)
+}
+
+func TestSlowConsumerPolicy(t *testing.T) {
+	assert.Nil(t, (&SubjectAndGroup{}).Validate())
+	assert.Nil(t, (&SubjectAndGroup{SlowConsumerPolicy: SlowConsumerPause}).Validate())
+	assert.EqualError(t, (&SubjectAndGroup{SlowConsumerPolicy: "block"}).Validate(),
+		"Unknown slow_consumer_policy 'block' - it must be 'drop' or 'pause'")
+}
+
+func TestReplyAckWithJetStream(t *testing.T) {
+	s := &SubjectAndGroup{ReplyAck: true, JetStream: &messaging.JetStreamConfig{Stream: "LOGS", Durable: "elastinats"}}
+	assert.EqualError(t, s.Validate(), "reply_ack can't be used with jetstream - the reply subject is used for the JetStream acks")
+}
+
+func TestNatsConnections(t *testing.T) {
+	config := &Config{
+		NatsConf: messaging.NatsConfig{Servers: []string{"nats://one:4222"}},
+		NatsConns: []NatsConnection{
+			{Name: "edge", NatsConfig: messaging.NatsConfig{Servers: []string{"nats://edge:4222"}}},
+		},
+	}
+
+	conns, err := config.NatsConnections()
+	assert.Nil(t, err)
+	assert.Len(t, conns, 2)
+	assert.Equal(t, []string{"nats://one:4222"}, conns[DefaultConnection].Servers)
+	assert.Equal(t, []string{"nats://edge:4222"}, conns["edge"].Servers)
+
+	assert.Equal(t, DefaultConnection, (&SubjectAndGroup{}).ConnectionName())
+	assert.Equal(t, "edge", (&SubjectAndGroup{Connection: "edge"}).ConnectionName())
+}
+
+func TestBadNatsConnections(t *testing.T) {
+	for _, conns := range [][]NatsConnection{
+		{{}},
+		{{Name: DefaultConnection}},
+		{{Name: "edge"}, {Name: "edge"}},
+	} {
+		_, err := (&Config{NatsConns: conns}).NatsConnections()
+		assert.NotNil(t, err)
+	}
+}
+
+func TestEndpointInheritance(t *testing.T) {
+	config := &Config{
+		ElasticConf: &ElasticConfig{
+			Index:           "logs-{{.Year}}",
+			Hosts:           []string{"es1", "es2"},
+			Port:            9200,
+			Type:            "log",
+			BatchSize:       100,
+			BatchTimeoutSec: 5,
+		},
+	}
+
+	endpoint, err := config.Endpoint(&SubjectAndGroup{})
+	assert.Nil(t, err)
+	assert.Equal(t, config.ElasticConf, endpoint)
+
+	endpoint, err = config.Endpoint(&SubjectAndGroup{Endpoint: &ElasticConfig{Index: "audit", BatchSize: 10}})
+	assert.Nil(t, err)
+	assert.Equal(t, "audit", endpoint.Index)
+	assert.Equal(t, 10, endpoint.BatchSize)
+	assert.Equal(t, []string{"es1", "es2"}, endpoint.Hosts)
+	assert.Equal(t, 9200, endpoint.Port)
+	assert.Equal(t, "log", endpoint.Type)
+	assert.Equal(t, 5, endpoint.BatchTimeoutSec)
+
+	// the default isn't touched
+	assert.Equal(t, "logs-{{.Year}}", config.ElasticConf.Index)
+	assert.Equal(t, 100, config.ElasticConf.BatchSize)
+
+	// the credentials only go along with the hosts
+	config.ElasticConf.User, config.ElasticConf.Password = "elastic", "secret"
+	endpoint, err = config.Endpoint(&SubjectAndGroup{Endpoint: &ElasticConfig{Index: "audit"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "elastic", endpoint.User)
+	assert.Equal(t, "secret", endpoint.Password)
+
+	endpoint, err = config.Endpoint(&SubjectAndGroup{Endpoint: &ElasticConfig{Hosts: []string{"other"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, "", endpoint.User)
+	assert.Equal(t, "", endpoint.Password)
+}
+
+func TestInvalidEndpoints(t *testing.T) {
+	_, err := (&Config{}).Endpoint(&SubjectAndGroup{})
+	assert.EqualError(t, err, "No consumer provided and there is no default handler")
+
+	_, err = (&Config{}).Endpoint(&SubjectAndGroup{Endpoint: &ElasticConfig{Index: "audit", Hosts: []string{"es"}, Port: 9200, Type: "log", BatchSize: 10}})
+	assert.EqualError(t, err, "The batch_timeout_sec must be positive, not 0")
+
+	valid := ElasticConfig{Index: "logs", Hosts: []string{"es"}, Port: 9200, Type: "log", BatchSize: 10, BatchTimeoutSec: 1}
+	assert.Nil(t, valid.Validate())
+
+	for _, broken := range []func(e *ElasticConfig){
+		func(e *ElasticConfig) { e.Index = "" },
+		func(e *ElasticConfig) { e.Index = "logs-{{.Year" },
+		func(e *ElasticConfig) { e.Hosts = nil },
+		func(e *ElasticConfig) { e.Port = 0 },
+		func(e *ElasticConfig) { e.Type = "" },
+		func(e *ElasticConfig) { e.BatchSize = -1 },
+	} {
+		e := valid
+		broken(&e)
+		assert.NotNil(t, e.Validate())
+	}
+}
+
+func TestProblems(t *testing.T) {
+	config := &Config{
+		ElasticConf: &ElasticConfig{Index: "logs", Hosts: []string{"es"}, Port: 9200, Type: "log", BatchSize: 10},
+		LogConf:     LoggingConfig{Level: "loud"},
+		Subjects: []SubjectAndGroup{
+			{Subject: "logs.>"},
+			{Connection: "edge", JetStream: &messaging.JetStreamConfig{Stream: "LOGS"}},
+			{Subject: "audit.>", SubjectFields: "audit.{", Multiline: &messaging.MultilineConfig{}},
+		},
+	}
+
+	paths := []string{}
+	for _, p := range config.Problems() {
+		paths = append(paths, p.Path)
+	}
+	assert.Equal(t, []string{
+		"elastic_conf",
+		"log_conf.log_level",
+		"subjects[1].subject",
+		"subjects[1].connection",
+		"subjects[1].jetstream",
+		"subjects[2].subject_fields",
+		"subjects[2].multiline",
+	}, paths)
+}
+
+func TestStatsConfig(t *testing.T) {
+	stats := StatsConfig{}
+	assert.Equal(t, "elastinats.stats.web-1_ams_example_com", stats.PublishSubject("web-1.ams.example.com"))
+	assert.Equal(t, "elastinats.stats.request", stats.WithDefaults().RequestSubject)
+	assert.Equal(t, DefaultConnection, stats.WithDefaults().Connection)
+	assert.Nil(t, stats.Validate())
+
+	stats.Subject = "stats.>"
+	assert.NotNil(t, stats.Validate())
+
+	config := &Config{
+		ElasticConf: &ElasticConfig{Index: "logs", Hosts: []string{"es"}, Port: 9200, Type: "log", BatchSize: 10, BatchTimeoutSec: 1},
+		Subjects:    []SubjectAndGroup{{Subject: "logs"}},
+		StatsConf:   &StatsConfig{Connection: "edge"},
+	}
+	paths := []string{}
+	for _, p := range config.Problems() {
+		paths = append(paths, p.Path)
+	}
+	assert.Contains(t, paths, "stats_conf.connection")
+}
+
+func TestIndexFromMissingField(t *testing.T) {
+	endpoint := &ElasticConfig{Index: "logs-{{.Fields.env}}", Hosts: []string{"es"}, Port: 9200, Type: "log", BatchSize: 10, BatchTimeoutSec: 1}
+	assert.Nil(t, endpoint.Validate())
+	assert.NotNil(t, endpoint.indexTemplate)
+
+	index, err := endpoint.GetIndex(time.Now(), messaging.Payload{"env": "Prod"})
+	assert.Nil(t, err)
+	assert.Equal(t, "logs-prod", index)
+
+	_, err = endpoint.GetIndex(time.Now(), messaging.Payload{"level": "info"})
+	assert.NotNil(t, err)
+	_, err = endpoint.GetIndex(time.Now(), messaging.Payload{"env": nil})
+	assert.NotNil(t, err)
+}
+
+func TestIndexFromMaliciousField(t *testing.T) {
+	endpoint := &ElasticConfig{Index: "{{.Fields.env}}", Hosts: []string{"es"}, Port: 9200, Type: "log", BatchSize: 10, BatchTimeoutSec: 1}
+	assert.Nil(t, endpoint.Validate())
+
+	for _, env := range []string{
+		"prod/log/_delete_by_query?q=*#",
+		"../other",
+		"..",
+		".",
+		"prod\\other",
+		"prod other",
+		"prod,other",
+		"prod:other",
+		"_all",
+		"-prod",
+		"",
+	} {
+		_, err := endpoint.GetIndex(time.Now(), messaging.Payload{"env": env})
+		assert.NotNil(t, err, env)
+	}
+
+	index, err := endpoint.GetIndex(time.Now(), messaging.Payload{"env": ".prod-2017.01"})
+	assert.Nil(t, err)
+	assert.Equal(t, ".prod-2017.01", index)
+}
@@ -0,0 +1,76 @@
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// filePrefix marks a value that is read from a file, e.g. 'file:/run/secrets/es_password'
+const filePrefix = "file:"
+
+// matches ${NAME} and ${NAME:-default}
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolate is the decode hook for every value of the config. Strings get their
+// environment variables replaced and 'file:' references read, and then split on
+// commas if they're decoded into a list.
+func interpolate(from, to reflect.Kind, data interface{}) (interface{}, error) {
+	if from != reflect.String {
+		return data, nil
+	}
+
+	value, err := expandEnv(data.(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(value, filePrefix) {
+		if value, err = readSecret(strings.TrimPrefix(value, filePrefix)); err != nil {
+			return nil, err
+		}
+	}
+
+	if to == reflect.Slice {
+		if value == "" {
+			return []string{}, nil
+		}
+		return strings.Split(value, ","), nil
+	}
+	return value, nil
+}
+
+// expandEnv replaces ${NAME} with the value of the environment variable, which
+// has to be set, and ${NAME:-default} with the default if it is empty or unset
+func expandEnv(value string) (string, error) {
+	var missing []string
+	expanded := envVarPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		parts := envVarPattern.FindStringSubmatch(ref)
+		name, hasDefault, def := parts[1], parts[2] != "", parts[3]
+
+		if env := os.Getenv(name); env != "" {
+			return env
+		}
+		if _, set := os.LookupEnv(name); !set && !hasDefault {
+			missing = append(missing, name)
+		}
+		return def
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("The environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// readSecret reads the file without the trailing newline that editors add
+func readSecret(path string) (string, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	return strings.TrimRight(string(bs), "\r\n"), nil
+}
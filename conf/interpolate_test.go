@@ -0,0 +1,90 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("ELASTINATS_TEST_HOST", "es.lo")
+	os.Setenv("ELASTINATS_TEST_EMPTY", "")
+	defer os.Unsetenv("ELASTINATS_TEST_HOST")
+	defer os.Unsetenv("ELASTINATS_TEST_EMPTY")
+
+	for value, expected := range map[string]string{
+		"plain":                                                       "plain",
+		"http://${ELASTINATS_TEST_HOST}:9200":                         "http://es.lo:9200",
+		"${ELASTINATS_TEST_MISSING:-fallback}":                        "fallback",
+		"${ELASTINATS_TEST_EMPTY:-fallback}":                          "fallback",
+		"${ELASTINATS_TEST_EMPTY}":                                    "",
+		"${ELASTINATS_TEST_HOST:-other}/${ELASTINATS_TEST_MISSING:-}": "es.lo/",
+	} {
+		expanded, err := expandEnv(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, expanded, value)
+	}
+
+	_, err := expandEnv("${ELASTINATS_TEST_MISSING}")
+	assert.EqualError(t, err, "The environment variable ELASTINATS_TEST_MISSING is not set")
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elastinats")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	secret := filepath.Join(dir, "password")
+	assert.Nil(t, ioutil.WriteFile(secret, []byte("s3cret\n"), 0600))
+	os.Setenv("ELASTINATS_TEST_PORT", "9201")
+	defer os.Unsetenv("ELASTINATS_TEST_PORT")
+
+	files := map[string]string{
+		"config.json": `{
+			"elastic_conf": {"hosts": ["es.lo"], "port": "${ELASTINATS_TEST_PORT}", "user": "elastinats", "password": "file:` + secret + `"},
+			"subjects": [{"subject": "logs.${ELASTINATS_TEST_ENV:-prod}"}]
+		}`,
+		"config.yaml": `
+elastic_conf:
+  hosts: [es.lo]
+  port: ${ELASTINATS_TEST_PORT}
+  user: elastinats
+  password: file:` + secret + `
+subjects:
+  - subject: logs.${ELASTINATS_TEST_ENV:-prod}
+`,
+		"config.toml": `
+[elastic_conf]
+hosts = ["es.lo"]
+port = "${ELASTINATS_TEST_PORT}"
+user = "elastinats"
+password = "file:` + secret + `"
+
+[[subjects]]
+subject = "logs.${ELASTINATS_TEST_ENV:-prod}"
+`,
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0600))
+
+		cmd := &cobra.Command{}
+		cmd.Flags().String("config", path, "")
+
+		config, err := LoadConfig(cmd)
+		if !assert.Nil(t, err, name) {
+			continue
+		}
+		assert.Equal(t, []string{"es.lo"}, config.ElasticConf.Hosts, name)
+		assert.Equal(t, 9201, config.ElasticConf.Port, name)
+		assert.Equal(t, "s3cret", config.ElasticConf.Password, name)
+		if assert.Len(t, config.Subjects, 1, name) {
+			assert.Equal(t, "logs.prod", config.Subjects[0].Subject, name)
+		}
+	}
+}
@@ -9,8 +9,17 @@ import (
 )
 
 type LoggingConfig struct {
-	Level string `mapstructure:"log_level" json:"log_level"`
-	File  string `mapstructure:"log_file" json:"log_file"`
+	Level string `mapstructure:"log_level" json:"log_level" desc:"The lowest level that is logged: debug, info, warn, error, fatal or panic" default:"info"`
+	File  string `mapstructure:"log_file" json:"log_file"  desc:"A file to log to instead of stderr"`
+}
+
+// Validate checks that the level is one logrus knows
+func (config *LoggingConfig) Validate() error {
+	if config.Level == "" {
+		return nil
+	}
+	_, err := logrus.ParseLevel(strings.ToUpper(config.Level))
+	return err
 }
 
 // ConfigureLogging will take the logging configuration and also adds
@@ -0,0 +1,227 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+
+	"github.com/netlify/elastinats/messaging"
+)
+
+// Redacted replaces the values of fields tagged with `secret:"true"`
+const Redacted = "REDACTED"
+
+// The sources a value can come from
+const (
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+	SourceDefault = "default"
+
+	// SourceInherited is used for the settings of a subject's endpoint that come
+	// from the default elastic_conf
+	SourceInherited = "elastic_conf"
+)
+
+// Description is the effective config along with where each value came from
+type Description struct {
+	Config  *Config           `json:"config"`
+	Sources map[string]string `json:"sources"`
+}
+
+// Describe resolves and redacts the config, and finds the source of every value
+func (c *Config) Describe() (*Description, error) {
+	resolved, err := c.Resolved()
+	if err != nil {
+		return nil, err
+	}
+	redact(reflect.ValueOf(resolved))
+
+	sources := make(map[string]string)
+	walkLeaves(reflect.ValueOf(resolved), "", func(key string) {
+		sources[key] = source(key)
+	})
+
+	return &Description{Config: resolved, Sources: sources}, nil
+}
+
+// Format renders the description as 'json' or 'yaml'
+func (d *Description) Format(format string) ([]byte, error) {
+	bs, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "", "json":
+		return bs, nil
+	case "yaml", "yml":
+		// json is yaml, going through it keeps the keys, their order and the numbers
+		var node yaml.Node
+		if err := yaml.Unmarshal(bs, &node); err != nil {
+			return nil, err
+		}
+		blockStyle(&node)
+		return yaml.Marshal(&node)
+	}
+	return nil, fmt.Errorf("Unknown format '%s' - it must be 'json' or 'yaml'", format)
+}
+
+// blockStyle drops the json style of the parsed nodes, strings that would read as
+// something else are still quoted
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// Resolved returns a copy of the config with the defaults that are applied when
+// running filled in, e.g. the effective endpoint and pending limits of each subject
+func (c *Config) Resolved() (*Config, error) {
+	// a deep copy so that nothing that is running is changed
+	bs, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	resolved := new(Config)
+	if err := json.Unmarshal(bs, resolved); err != nil {
+		return nil, err
+	}
+
+	natsConfs := []*messaging.NatsConfig{&resolved.NatsConf}
+	for i := range resolved.NatsConns {
+		natsConfs = append(natsConfs, &resolved.NatsConns[i].NatsConfig)
+	}
+	for _, nc := range natsConfs {
+		if nc.ClosedPolicy == "" {
+			nc.ClosedPolicy = messaging.ClosedPolicyWait
+		}
+		if nc.MaxReconnects == 0 {
+			nc.MaxReconnects = -1
+		}
+	}
+	if resolved.StatsConf != nil {
+		stats := resolved.StatsConf.WithDefaults()
+		resolved.StatsConf = &stats
+	}
+	for i := range resolved.Subjects {
+		pair := &resolved.Subjects[i]
+		if endpoint, err := resolved.Endpoint(pair); err == nil {
+			copied := *endpoint
+			pair.Endpoint = &copied
+		}
+		pair.Connection = pair.ConnectionName()
+		pair.PendingMsgsLimit, pair.PendingBytesLimit = pair.PendingLimits()
+		if pair.SlowConsumerPolicy == "" {
+			pair.SlowConsumerPolicy = SlowConsumerDrop
+		}
+		if pair.Multiline != nil {
+			multiline := pair.Multiline.WithDefaults()
+			pair.Multiline = &multiline
+		}
+		if pair.Headers != nil {
+			headers := pair.Headers.WithDefaults()
+			pair.Headers = &headers
+		}
+	}
+
+	return resolved, nil
+}
+
+// redact blanks out every secret that is set
+func redact(val reflect.Value) {
+	switch val.Kind() {
+	case reflect.Ptr:
+		if !val.IsNil() {
+			redact(val.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < val.Len(); i++ {
+			redact(val.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < val.NumField(); i++ {
+			field := val.Field(i)
+			if !field.CanSet() {
+				continue
+			}
+			if val.Type().Field(i).Tag.Get("secret") == "true" && field.Kind() == reflect.String {
+				if field.String() != "" {
+					field.SetString(Redacted)
+				}
+				continue
+			}
+			redact(field)
+		}
+	}
+}
+
+// walkLeaves calls leaf with the key of every value in the config, sections that
+// aren't set are skipped
+func walkLeaves(val reflect.Value, key string, leaf func(string)) {
+	switch val.Kind() {
+	case reflect.Ptr:
+		if !val.IsNil() {
+			walkLeaves(val.Elem(), key, leaf)
+		}
+	case reflect.Struct:
+		for i := 0; i < val.NumField(); i++ {
+			field := val.Type().Field(i)
+			if !val.Field(i).CanSet() {
+				continue
+			}
+			if field.Anonymous {
+				walkLeaves(val.Field(i), key, leaf)
+				continue
+			}
+			if tag := getTag(field); tag != "-" {
+				walkLeaves(val.Field(i), join(key, tag), leaf)
+			}
+		}
+	case reflect.Slice:
+		if val.Type().Elem().Kind() != reflect.Struct {
+			leaf(key)
+			return
+		}
+		for i := 0; i < val.Len(); i++ {
+			walkLeaves(val.Index(i), fmt.Sprintf("%s.%d", key, i), leaf)
+		}
+	default:
+		leaf(key)
+	}
+}
+
+func join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// source finds where the value for the key came from, with the same precedence
+// that was used to load it
+func source(key string) string {
+	if hasEnv(key) {
+		return SourceEnv
+	}
+	if viper.IsSet(key) && !viper.InConfig(key) {
+		return SourceFlag
+	}
+	if viper.InConfig(key) {
+		return SourceFile
+	}
+
+	// subjects.N.elastic_conf.x falls back to elastic_conf.x
+	parts := strings.SplitN(key, ".", 4)
+	if len(parts) == 4 && parts[0] == "subjects" && parts[2] == "elastic_conf" {
+		if src := source("elastic_conf." + parts[3]); src != SourceDefault {
+			return SourceInherited
+		}
+	}
+	return SourceDefault
+}
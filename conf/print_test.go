@@ -0,0 +1,76 @@
+package conf
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/elastinats/messaging"
+)
+
+func TestDescribe(t *testing.T) {
+	// nothing comes from a file
+	viper.Reset()
+	os.Setenv("ELASTINATS_ELASTIC_CONF_INDEX", "logs")
+	defer os.Unsetenv("ELASTINATS_ELASTIC_CONF_INDEX")
+
+	config := &Config{
+		NatsConf: messaging.NatsConfig{Token: "nats-token"},
+		ElasticConf: &ElasticConfig{
+			Index:           "logs",
+			Hosts:           []string{"es"},
+			Port:            9200,
+			Type:            "log",
+			BatchSize:       10,
+			BatchTimeoutSec: 1,
+			User:            "elastinats",
+			Password:        "es-password",
+		},
+		Subjects: []SubjectAndGroup{
+			{Subject: "logs.>"},
+			{Subject: "audit.>", Endpoint: &ElasticConfig{Index: "audit"}, Multiline: &messaging.MultilineConfig{Pattern: "^\\s"}},
+		},
+	}
+
+	description, err := config.Describe()
+	assert.Nil(t, err)
+
+	resolved := description.Config
+	assert.Equal(t, Redacted, resolved.NatsConf.Token)
+	assert.Equal(t, Redacted, resolved.ElasticConf.Password)
+	assert.Equal(t, "elastinats", resolved.ElasticConf.User)
+	assert.Equal(t, messaging.ClosedPolicyWait, resolved.NatsConf.ClosedPolicy)
+	assert.Equal(t, -1, resolved.NatsConf.MaxReconnects)
+
+	assert.Equal(t, "logs", resolved.Subjects[0].Endpoint.Index)
+	assert.Equal(t, DefaultConnection, resolved.Subjects[0].Connection)
+	assert.Equal(t, SlowConsumerDrop, resolved.Subjects[0].SlowConsumerPolicy)
+	assert.Equal(t, "audit", resolved.Subjects[1].Endpoint.Index)
+	assert.Equal(t, Redacted, resolved.Subjects[1].Endpoint.Password)
+	assert.Equal(t, 500, resolved.Subjects[1].Multiline.MaxLines)
+
+	// the running config isn't touched
+	assert.Equal(t, "es-password", config.ElasticConf.Password)
+	assert.Nil(t, config.Subjects[0].Endpoint)
+
+	assert.Equal(t, SourceEnv, description.Sources["elastic_conf.index"])
+	assert.Equal(t, SourceDefault, description.Sources["elastic_conf.port"])
+	assert.Equal(t, SourceInherited, description.Sources["subjects.1.elastic_conf.index"])
+	assert.Equal(t, SourceDefault, description.Sources["subjects.1.elastic_conf.port"])
+
+	out, err := description.Format("json")
+	assert.Nil(t, err)
+	assert.True(t, json.Valid(out))
+	assert.NotContains(t, string(out), "es-password")
+
+	out, err = description.Format("yaml")
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(out), "password: REDACTED"))
+
+	_, err = description.Format("xml")
+	assert.NotNil(t, err)
+}
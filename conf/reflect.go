@@ -3,13 +3,26 @@ package conf
 import (
 	"errors"
 	"fmt"
+	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 var tagPrefix = "viper"
 
+// envPrefix is put in front of every environment variable, e.g. ELASTINATS_SUBJECTS_0_SUBJECT
+const envPrefix = "ELASTINATS"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// populateConfig sets everything that comes from the environment, flags or defaults
+// on top of what was loaded from the file. Lists, maps and optional sections can be
+// created from the environment: ELASTINATS_SUBJECTS_1_ELASTIC_CONF_INDEX creates the
+// second subject and its endpoint if the file doesn't have them.
 func populateConfig(config *Config) (*Config, error) {
 	err := recursivelySet(reflect.ValueOf(config), "")
 	if err != nil {
@@ -37,39 +50,241 @@ func recursivelySet(val reflect.Value, prefix string) error {
 	for i := 0; i < val.NumField(); i++ {
 		thisField := val.Field(i)
 		thisType := vType.Field(i)
-		tag := prefix + getTag(thisType)
+		if !thisField.CanSet() {
+			continue
+		}
 
-		switch thisField.Kind() {
-		case reflect.Struct:
-			if err := recursivelySet(thisField.Addr(), tag+"."); err != nil {
+		// squashed structs share the prefix of their parent
+		if thisType.Anonymous {
+			if err := recursivelySet(thisField.Addr(), prefix); err != nil {
 				return err
 			}
-		case reflect.Int:
-			fallthrough
-		case reflect.Int32:
-			fallthrough
-		case reflect.Int64:
-			// you can only set with an int64 -> int
-			configVal := int64(viper.GetInt(tag))
-			thisField.SetInt(configVal)
-		case reflect.String:
-			thisField.SetString(viper.GetString(tag))
-		case reflect.Bool:
-			thisField.SetBool(viper.GetBool(tag))
-		default:
-			return fmt.Errorf("unexpected type detected ~ aborting: %s", thisField.Kind())
+			continue
+		}
+
+		tag := getTag(thisType)
+		if tag == "-" {
+			continue
+		}
+		if err := setValue(thisField, prefix+tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setValue(field reflect.Value, key string) error {
+	switch field.Kind() {
+	case reflect.Struct:
+		return recursivelySet(field.Addr(), key+".")
+	case reflect.Ptr:
+		if field.IsNil() {
+			// only create optional sections that are configured
+			if !hasEnv(key) {
+				return nil
+			}
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		return setValue(field.Elem(), key)
+	case reflect.Slice:
+		return setSlice(field, key)
+	case reflect.Map:
+		return setMap(field, key)
+	}
+
+	if !shouldSet(key) {
+		return nil
+	}
+	raw := lookup(key)
+	if str, ok := raw.(string); ok {
+		expanded, err := interpolate(reflect.String, reflect.String, str)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		raw = expanded
+	}
+	return setScalar(field, key, fmt.Sprint(raw))
+}
+
+// setSlice sets the whole list from a comma separated value, and the items that
+// are set by their index, e.g. ELASTINATS_ELASTIC_CONF_HOSTS_2
+func setSlice(field reflect.Value, key string) error {
+	elemType := field.Type().Elem()
+	if isScalar(elemType) && shouldSet(key) {
+		var values []string
+		if str, ok := lookup(key).(string); ok {
+			split, err := interpolate(reflect.String, reflect.Slice, str)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			values = split.([]string)
+		} else {
+			values = viper.GetStringSlice(key)
+		}
+
+		list := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, v := range values {
+			if err := setScalar(list.Index(i), key, strings.TrimSpace(v)); err != nil {
+				return err
+			}
+		}
+		field.Set(list)
+	}
+
+	if n := maxEnvIndex(key) + 1; n > field.Len() {
+		grown := reflect.MakeSlice(field.Type(), n, n)
+		reflect.Copy(grown, field)
+		field.Set(grown)
+	}
+
+	for i := 0; i < field.Len(); i++ {
+		if err := setValue(field.Index(i), fmt.Sprintf("%s.%d", key, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setMap sets the entries of maps with simple values, the rest of the name of the
+// variable is the key: ELASTINATS_ENRICH_CONF_STATIC_DATACENTER=ams -> datacenter: ams
+func setMap(field reflect.Value, key string) error {
+	elemType := field.Type().Elem()
+	if field.Type().Key().Kind() != reflect.String || !isScalar(elemType) {
+		return nil
+	}
+
+	prefix := envName(key) + "_"
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], prefix) || len(parts[0]) == len(prefix) {
+			continue
+		}
+		mapKey := strings.ToLower(strings.TrimPrefix(parts[0], prefix))
+
+		expanded, err := interpolate(reflect.String, reflect.String, parts[1])
+		if err != nil {
+			return fmt.Errorf("%s.%s: %v", key, mapKey, err)
+		}
+		value := reflect.New(elemType).Elem()
+		if err := setScalar(value, key+"."+mapKey, expanded.(string)); err != nil {
+			return err
+		}
+
+		if field.IsNil() {
+			field.Set(reflect.MakeMap(field.Type()))
 		}
+		field.SetMapIndex(reflect.ValueOf(mapKey).Convert(field.Type().Key()), value)
 	}
+	return nil
+}
 
+func setScalar(field reflect.Value, key, raw string) error {
+	var err error
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(raw); err == nil {
+			field.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if field.Type() == durationType {
+			var d time.Duration
+			d, err = time.ParseDuration(raw)
+			i = int64(d)
+		} else {
+			i, err = strconv.ParseInt(raw, 10, 64)
+		}
+		if err == nil {
+			field.SetInt(i)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		if u, err = strconv.ParseUint(raw, 10, 64); err == nil {
+			field.SetUint(u)
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(raw, 64); err == nil {
+			field.SetFloat(f)
+		}
+	default:
+		return fmt.Errorf("unexpected type detected ~ aborting: %s", field.Kind())
+	}
+
+	if err != nil {
+		return fmt.Errorf("Invalid value '%s' for %s: %v", raw, key, err)
+	}
 	return nil
 }
 
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		return false
+	}
+	return true
+}
+
+// shouldSet is true if the value comes from the environment, or from a flag or
+// default. Values from the file were already decoded and interpolated.
+func shouldSet(key string) bool {
+	if _, ok := os.LookupEnv(envName(key)); ok {
+		return true
+	}
+	return viper.IsSet(key) && !viper.InConfig(key)
+}
+
+// lookup prefers the environment, so that it doesn't depend on how viper was set up
+func lookup(key string) interface{} {
+	if env, ok := os.LookupEnv(envName(key)); ok {
+		return env
+	}
+	return viper.Get(key)
+}
+
+// hasEnv is true if there is a variable for the key or anything below it
+func hasEnv(key string) bool {
+	name := envName(key)
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, name+"=") || strings.HasPrefix(env, name+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// maxEnvIndex is the highest list index that is set for the key, or -1
+func maxEnvIndex(key string) int {
+	prefix := envName(key) + "_"
+	max := -1
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		index := strings.SplitN(strings.TrimPrefix(name, prefix), "_", 2)[0]
+		if i, err := strconv.Atoi(index); err == nil && i > max {
+			max = i
+		}
+	}
+	return max
+}
+
+// envName is the variable viper checks for the key: subjects.0.subject -> ELASTINATS_SUBJECTS_0_SUBJECT
+func envName(key string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
 func getTag(field reflect.StructField) string {
 	// check if maybe we have a special magic tag
 	tag := field.Tag
 	if tag != "" {
 		for _, prefix := range []string{tagPrefix, "mapstructure", "json"} {
-			if v := tag.Get(prefix); v != "" {
+			if v := strings.Split(tag.Get(prefix), ",")[0]; v != "" {
 				return v
 			}
 		}
@@ -1,8 +1,10 @@
 package conf
 
 import (
+	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -40,3 +42,72 @@ func TestNestedValues(t *testing.T) {
 	assert.Equal(t, "i am a simple string", c.Nested.StringVal)
 	assert.Equal(t, true, c.Nested.BoolVal)
 }
+
+func TestEnvironmentOnlyConfig(t *testing.T) {
+	env := map[string]string{
+		"ELASTINATS_REPORT_SEC":                       "30",
+		"ELASTINATS_NATS_CONF_SERVERS":                "nats://one:4222,nats://two:4222",
+		"ELASTINATS_ELASTIC_CONF_HOSTS_0":             "es1",
+		"ELASTINATS_ELASTIC_CONF_HOSTS_1":             "es2",
+		"ELASTINATS_ELASTIC_CONF_PORT":                "9200",
+		"ELASTINATS_SUBJECTS_0_SUBJECT":               "logs.>",
+		"ELASTINATS_SUBJECTS_1_SUBJECT":               "audit.>",
+		"ELASTINATS_SUBJECTS_1_REPLY_ACK":             "true",
+		"ELASTINATS_SUBJECTS_1_ELASTIC_CONF_INDEX":    "audit",
+		"ELASTINATS_NATS_CONNS_0_NAME":                "edge",
+		"ELASTINATS_NATS_CONNS_0_TOKEN":               "secret",
+		"ELASTINATS_ENRICH_CONF_STATIC_DATACENTER":    "ams",
+		"ELASTINATS_ENRICH_CONF_STATIC_ENVIRONMENT":   "prod",
+		"ELASTINATS_SUBJECTS_0_PAYLOAD_CONF_MAX_KEYS": "100",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	config := &Config{
+		Subjects: []SubjectAndGroup{{Subject: "from.file", Group: "file"}},
+	}
+	_, err := populateConfig(config)
+	assert.Nil(t, err)
+
+	assert.EqualValues(t, 30, config.ReportSec)
+	assert.Equal(t, []string{"nats://one:4222", "nats://two:4222"}, config.NatsConf.Servers)
+	if assert.NotNil(t, config.ElasticConf) {
+		assert.Equal(t, []string{"es1", "es2"}, config.ElasticConf.Hosts)
+		assert.Equal(t, 9200, config.ElasticConf.Port)
+	}
+
+	if assert.Len(t, config.Subjects, 2) {
+		assert.Equal(t, "logs.>", config.Subjects[0].Subject)
+		assert.Equal(t, "file", config.Subjects[0].Group)
+		assert.Equal(t, 100, config.Subjects[0].PayloadConf.MaxKeys)
+		assert.Nil(t, config.Subjects[0].Endpoint)
+
+		assert.Equal(t, "audit.>", config.Subjects[1].Subject)
+		assert.True(t, config.Subjects[1].ReplyAck)
+		assert.Equal(t, "audit", config.Subjects[1].Endpoint.Index)
+	}
+
+	if assert.Len(t, config.NatsConns, 1) {
+		assert.Equal(t, "edge", config.NatsConns[0].Name)
+		assert.Equal(t, "secret", config.NatsConns[0].Token)
+	}
+	assert.Equal(t, map[string]string{"datacenter": "ams", "environment": "prod"}, config.EnrichConf.Static)
+}
+
+func TestDurationsAndBadValues(t *testing.T) {
+	c := struct {
+		Wait  time.Duration `json:"wait"`
+		Count int           `json:"count"`
+	}{}
+
+	os.Setenv("ELASTINATS_WAIT", "1m30s")
+	defer os.Unsetenv("ELASTINATS_WAIT")
+	assert.Nil(t, recursivelySet(reflect.ValueOf(&c), ""))
+	assert.Equal(t, 90*time.Second, c.Wait)
+
+	os.Setenv("ELASTINATS_COUNT", "lots")
+	defer os.Unsetenv("ELASTINATS_COUNT")
+	assert.EqualError(t, recursivelySet(reflect.ValueOf(&c), ""), `Invalid value 'lots' for count: strconv.ParseInt: parsing "lots": invalid syntax`)
+}
@@ -0,0 +1,157 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// SchemaFile is where the schema is checked in, it is regenerated with
+// 'elastinats config schema > config.schema.json'
+const SchemaFile = "config.schema.json"
+
+// interpolated matches the values that are only filled in when the config is
+// loaded, they can be used where a number, boolean or one of a list is expected
+var interpolated = map[string]interface{}{
+	"type":        "string",
+	"pattern":     `\$\{[A-Za-z_][A-Za-z0-9_]*(:-[^}]*)?\}|^file:`,
+	"description": "An environment variable like ${NAME} or ${NAME:-default}, or file:<path> to read the value from a file",
+}
+
+// Schema returns the JSON Schema of the config file. It is built from the struct
+// tags of the config: the 'desc', 'default' and 'enum' tags are the description,
+// default and allowed values of a setting.
+func Schema() ([]byte, error) {
+	root, err := structSchema(reflect.TypeOf(Config{}))
+	if err != nil {
+		return nil, err
+	}
+	root["$schema"] = "http://json-schema.org/draft-07/schema#"
+	root["title"] = "elastinats configuration"
+	root["definitions"] = map[string]interface{}{"interpolated": interpolated}
+
+	// so that a config can point to the schema
+	root["properties"].(map[string]interface{})["$schema"] = map[string]interface{}{
+		"type":        "string",
+		"description": "The schema the file is checked against",
+	}
+
+	out := new(bytes.Buffer)
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(root); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func structSchema(t reflect.Type) (map[string]interface{}, error) {
+	properties := make(map[string]interface{})
+	if err := addProperties(t, properties); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}, nil
+}
+
+// addProperties adds a property for every field, squashed structs add theirs to the parent
+func addProperties(t reflect.Type, properties map[string]interface{}) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		if field.Anonymous {
+			if err := addProperties(field.Type, properties); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag := getTag(field)
+		if tag == "-" {
+			continue
+		}
+		prop, err := fieldSchema(field)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %v", t.Name(), field.Name, err)
+		}
+		properties[tag] = prop
+	}
+	return nil
+}
+
+func fieldSchema(field reflect.StructField) (map[string]interface{}, error) {
+	schema, err := typeSchema(field.Type, field.Tag.Get("enum"))
+	if err != nil {
+		return nil, err
+	}
+
+	if desc := field.Tag.Get("desc"); desc != "" {
+		schema["description"] = desc
+	}
+	if raw, ok := field.Tag.Lookup("default"); ok {
+		value := reflect.New(field.Type).Elem()
+		if err := setScalar(value, "default", raw); err != nil {
+			return nil, err
+		}
+		schema["default"] = value.Interface()
+	}
+	return schema, nil
+}
+
+func typeSchema(t reflect.Type, enum string) (map[string]interface{}, error) {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), enum)
+	case reflect.Struct:
+		return structSchema(t)
+	case reflect.Slice:
+		items, err := typeSchema(t.Elem(), "")
+		if err != nil {
+			return nil, err
+		}
+		list := map[string]interface{}{"type": "array", "items": items}
+		if !isScalar(t.Elem()) {
+			return list, nil
+		}
+		// strings are split on commas
+		return anyOf(list, map[string]interface{}{"type": "string"}), nil
+	case reflect.Map:
+		values, err := typeSchema(t.Elem(), "")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "object", "additionalProperties": values}, nil
+	}
+
+	var schema map[string]interface{}
+	switch t.Kind() {
+	case reflect.String:
+		schema = map[string]interface{}{"type": "string"}
+		if enum == "" {
+			return schema, nil
+		}
+		schema["enum"] = strings.Split(enum, ",")
+	case reflect.Bool:
+		schema = map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema = map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		schema = map[string]interface{}{"type": "number"}
+	default:
+		return nil, fmt.Errorf("No schema for values of type %s", t)
+	}
+	return anyOf(schema, map[string]interface{}{"$ref": "#/definitions/interpolated"}), nil
+}
+
+func anyOf(schemas ...interface{}) map[string]interface{} {
+	return map[string]interface{}{"anyOf": schemas}
+}
@@ -0,0 +1,75 @@
+package conf
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaInSync(t *testing.T) {
+	generated, err := Schema()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	checkedIn, err := ioutil.ReadFile(filepath.Join("..", SchemaFile))
+	assert.Nil(t, err)
+	assert.Equal(t, string(checkedIn), string(generated),
+		"The config changed - run 'elastinats config schema > %s'", SchemaFile)
+}
+
+func TestSchemaDescriptions(t *testing.T) {
+	generated, err := Schema()
+	if !assert.Nil(t, err) {
+		return
+	}
+	schema := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(generated, &schema))
+
+	props := schema["properties"].(map[string]interface{})
+	assert.Contains(t, props, "subjects")
+	assert.Contains(t, props, "nats_conns")
+
+	// the squashed nats config is part of the named connections
+	conns := props["nats_conns"].(map[string]interface{})["items"].(map[string]interface{})
+	assert.Contains(t, conns["properties"], "name")
+	assert.Contains(t, conns["properties"], "servers")
+
+	subject := props["subjects"].(map[string]interface{})["items"].(map[string]interface{})["properties"].(map[string]interface{})
+	policy := subject["slow_consumer_policy"].(map[string]interface{})
+	assert.Equal(t, SlowConsumerDrop, policy["default"])
+	assert.Equal(t, []interface{}{SlowConsumerDrop, SlowConsumerPause}, policy["anyOf"].([]interface{})[0].(map[string]interface{})["enum"])
+	assert.Equal(t, float64(-1), subject["pending_msgs_limit"].(map[string]interface{})["default"])
+
+	var check func(path string, props map[string]interface{})
+	check = func(path string, props map[string]interface{}) {
+		for name, p := range props {
+			prop := p.(map[string]interface{})
+			if name != "$schema" {
+				assert.NotEmpty(t, prop["description"], "%s%s is missing a desc tag", path, name)
+			}
+			for _, nested := range nestedObjects(prop) {
+				check(path+name+".", nested)
+			}
+		}
+	}
+	check("", props)
+}
+
+// nestedObjects finds the properties of objects within the property
+func nestedObjects(prop map[string]interface{}) []map[string]interface{} {
+	found := []map[string]interface{}{}
+	if props, ok := prop["properties"].(map[string]interface{}); ok {
+		found = append(found, props)
+	}
+	if items, ok := prop["items"].(map[string]interface{}); ok {
+		found = append(found, nestedObjects(items)...)
+	}
+	if values, ok := prop["additionalProperties"].(map[string]interface{}); ok {
+		found = append(found, nestedObjects(values)...)
+	}
+	return found
+}
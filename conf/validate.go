@@ -0,0 +1,113 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/netlify/elastinats/messaging"
+)
+
+// Problem is something wrong with the setting at Path, e.g. 'subjects[2].jetstream'
+type Problem struct {
+	Path string
+	Err  error
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %v", p.Path, p.Err)
+}
+
+// Problems checks every part of the config and returns everything that is wrong
+// with it, not just the first problem. It doesn't connect to anything.
+func (c *Config) Problems() []Problem {
+	problems := []Problem{}
+	add := func(path string, err error) {
+		if err != nil {
+			problems = append(problems, Problem{Path: path, Err: err})
+		}
+	}
+
+	add("nats_conf", c.NatsConf.Validate())
+	for i := range c.NatsConns {
+		add(fmt.Sprintf("nats_conns[%d]", i), c.NatsConns[i].Validate())
+	}
+	conns, err := c.NatsConnections()
+	add("nats_conns", err)
+
+	if c.ElasticConf != nil {
+		add("elastic_conf", c.ElasticConf.Validate())
+	}
+	add("log_conf.log_level", c.LogConf.Validate())
+
+	if c.ReportSec < 0 {
+		add("report_sec", fmt.Errorf("The report_sec can't be negative, not %d", c.ReportSec))
+	}
+	if c.WatchConfigSec < 0 {
+		add("watch_config_sec", fmt.Errorf("The watch_config_sec can't be negative, not %d", c.WatchConfigSec))
+	}
+	if c.BufferSize < 0 {
+		add("buffer_size", fmt.Errorf("The buffer_size can't be negative, not %d", c.BufferSize))
+	}
+
+	if c.AdminConf != nil {
+		if c.AdminConf.Listen == "" {
+			add("admin_conf.listen", errors.New("An address to listen on is required"))
+		}
+		if c.AdminConf.ReadyBulkSec < 0 {
+			add("admin_conf.ready_bulk_sec", fmt.Errorf("The ready_bulk_sec can't be negative, not %d", c.AdminConf.ReadyBulkSec))
+		}
+		if c.AdminConf.ReadyBufferPercent < 0 || c.AdminConf.ReadyBufferPercent > 100 {
+			add("admin_conf.ready_buffer_percent", fmt.Errorf("The ready_buffer_percent must be between 0 and 100, not %d", c.AdminConf.ReadyBufferPercent))
+		}
+	}
+
+	if c.StatsConf != nil {
+		add("stats_conf", c.StatsConf.Validate())
+		if name := c.StatsConf.WithDefaults().Connection; conns != nil {
+			if _, ok := conns[name]; !ok {
+				add("stats_conf.connection", fmt.Errorf("Unknown nats connection '%s'", name))
+			}
+		}
+	}
+
+	if len(c.Subjects) == 0 {
+		add("subjects", errors.New("At least one subject is required"))
+	}
+	for i := range c.Subjects {
+		pair := &c.Subjects[i]
+		path := fmt.Sprintf("subjects[%d]", i)
+
+		if pair.Subject == "" {
+			add(path+".subject", errors.New("A subject is required"))
+		}
+		add(path, pair.Validate())
+
+		if conns != nil {
+			if _, ok := conns[pair.ConnectionName()]; !ok {
+				add(path+".connection", fmt.Errorf("Unknown nats connection '%s'", pair.ConnectionName()))
+			}
+		}
+
+		// only complain about the default endpoint once
+		if pair.Endpoint != nil || c.ElasticConf == nil {
+			_, err := c.Endpoint(pair)
+			add(path+".elastic_conf", err)
+		}
+
+		if pair.SubjectFields != "" {
+			_, err := messaging.NewSubjectMapping(pair.SubjectFields)
+			add(path+".subject_fields", err)
+		}
+		if pair.Multiline != nil {
+			add(path+".multiline", pair.Multiline.Validate())
+		}
+		if pair.JetStream != nil {
+			add(path+".jetstream", pair.JetStream.Validate())
+		}
+		if pair.PayloadConf != nil && (pair.PayloadConf.MaxDepth < 0 || pair.PayloadConf.MaxKeys < 0) {
+			add(path+".payload_conf", errors.New("max_depth and max_keys can't be negative"))
+		}
+	}
+
+	return problems
+}
@@ -3,10 +3,13 @@ package elastic
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -30,7 +33,43 @@ var client = http.Client{
 	Timeout: time.Second * 2,
 }
 
-func BatchAndSend(config *conf.ElasticConfig, incoming <-chan messaging.Payload, stats *stats.Counters, log *logrus.Entry) chan<- bool {
+// Batcher is a running BatchAndSend
+type Batcher struct {
+	shutdown chan bool
+	done     chan bool
+	flush    chan chan int
+	batching chan batching
+}
+
+type batching struct {
+	size       int
+	timeoutSec int
+	done       chan bool
+}
+
+// Shutdown sends on what is buffered along with the current batch and stops. It
+// returns once that and the batches that were still being sent are done.
+func (b *Batcher) Shutdown() {
+	b.shutdown <- true
+	<-b.done
+}
+
+// Flush sends the current batch right away and returns how many messages it had
+func (b *Batcher) Flush() int {
+	done := make(chan int)
+	b.flush <- done
+	return <-done
+}
+
+// SetBatching changes the batch size and timeout, the current batch is sent
+// if it is already big enough. It returns once the change is made.
+func (b *Batcher) SetBatching(size, timeoutSec int) {
+	done := make(chan bool)
+	b.batching <- batching{size: size, timeoutSec: timeoutSec, done: done}
+	<-done
+}
+
+func BatchAndSend(config *conf.ElasticConfig, incoming <-chan messaging.Message, stats *stats.Counters, log *logrus.Entry) *Batcher {
 	log.WithFields(logrus.Fields{
 		"hosts":         config.Hosts,
 		"port":          config.Port,
@@ -39,49 +78,117 @@ func BatchAndSend(config *conf.ElasticConfig, incoming <-chan messaging.Payload,
 		"type":          config.Type,
 	}).Info("Starting to consume forever and batch send to ES")
 
-	batch := make([]messaging.Payload, 0, config.BatchSize)
+	batchSize := config.BatchSize
+	batch := make([]messaging.Message, 0, batchSize)
+
+	sendTimeout := time.NewTicker(time.Duration(config.BatchTimeoutSec) * time.Second)
+	b := &Batcher{
+		shutdown: make(chan bool),
+		done:     make(chan bool),
+		flush:    make(chan chan int),
+		batching: make(chan batching),
+	}
 
-	sendTimeout := time.Tick(time.Duration(config.BatchTimeoutSec) * time.Second)
-	shutdown := make(chan bool)
+	// hands the batch off to be sent in the background
+	sending := sync.WaitGroup{}
+	send := func() int {
+		toSend := make([]messaging.Message, len(batch))
+		copy(toSend, batch)
+		batch = make([]messaging.Message, 0, batchSize)
+
+		sending.Add(1)
+		go func() {
+			defer sending.Done()
+			sendToES(config, log, stats, toSend)
+		}()
+		return len(toSend)
+	}
 
 	// spawn this off to a child routine
 	go func() {
+		defer sendTimeout.Stop()
 		for {
 			select {
 			case in := <-incoming:
+				stats.IncrementMessagesConsumed()
 				batch = append(batch, in)
-				if len(batch) >= config.BatchSize {
+				if len(batch) >= batchSize {
 					log.WithField("size", len(batch)).Debug("Sending batch because of size")
-
-					toSend := make([]messaging.Payload, len(batch))
-					copy(toSend, batch)
-					batch = make([]messaging.Payload, 0, config.BatchSize)
-
-					go sendToES(config, log, stats, toSend)
+					send()
 				}
-			case <-sendTimeout:
+			case <-sendTimeout.C:
 				log.WithField("size", len(batch)).Debug("Sending batch because of timeout")
+				send()
+			case done := <-b.flush:
+				log.WithField("size", len(batch)).Info("Sending batch because it was flushed")
+				done <- send()
+			case change := <-b.batching:
+				log.WithFields(logrus.Fields{
+					"batch_size":    change.size,
+					"batch_timeout": change.timeoutSec,
+				}).Info("Changing the batching")
+				batchSize = change.size
+				sendTimeout.Reset(time.Duration(change.timeoutSec) * time.Second)
+				stats.SetBatching(change.size, change.timeoutSec)
+				if len(batch) >= batchSize {
+					send()
+				}
+				close(change.done)
+			case <-b.shutdown:
+				// whatever is already buffered goes out with the last batch
+				for drained := false; !drained; {
+					select {
+					case in := <-incoming:
+						stats.IncrementMessagesConsumed()
+						batch = append(batch, in)
+					default:
+						drained = true
+					}
+				}
 
-				toSend := make([]messaging.Payload, len(batch))
-				copy(toSend, batch)
-				batch = make([]messaging.Payload, 0, config.BatchSize)
-
-				go sendToES(config, log, stats, toSend)
-			case <-shutdown:
-				log.Debug("Shutting down")
-				break
+				log.WithField("size", len(batch)).Debug("Sending last batch and shutting down")
+				sendToES(config, log, stats, batch)
+				sending.Wait()
+				close(b.done)
+				return
 			}
 		}
 	}()
 
-	return shutdown
+	return b
 }
 
-func sendToES(config *conf.ElasticConfig, log *logrus.Entry, stats *stats.Counters, batch []messaging.Payload) {
+func sendToES(config *conf.ElasticConfig, log *logrus.Entry, stats *stats.Counters, batch []messaging.Message) {
 	if len(batch) == 0 {
 		return
 	}
 
+	// the index template can use fields of the payload, so the batch might
+	// have to be split into a bulk request per index. The messages that don't
+	// have the fields fail on their own.
+	now := time.Now().UTC()
+	indexes := []string{}
+	byIndex := make(map[string][]messaging.Message)
+	for _, in := range batch {
+		index, err := config.GetIndex(now, in.Payload)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to build the index from %s", config.Index)
+			stats.IncrementErrors("index_template", 1)
+			in.Finish(messaging.IndexResult{Err: err})
+			continue
+		}
+		if _, ok := byIndex[index]; !ok {
+			indexes = append(indexes, index)
+		}
+		byIndex[index] = append(byIndex[index], in)
+	}
+
+	for _, index := range indexes {
+		sendBulk(config, log, stats, index, byIndex[index])
+	}
+}
+
+func sendBulk(config *conf.ElasticConfig, log *logrus.Entry, stats *stats.Counters, index string, batch []messaging.Message) {
 	log = log.WithFields(logrus.Fields{
 		"size":     len(batch),
 		"batch_id": rand.Int(),
@@ -89,12 +196,6 @@ func sendToES(config *conf.ElasticConfig, log *logrus.Entry, stats *stats.Counte
 
 	host := config.Hosts[rand.Intn(len(config.Hosts))]
 	log = log.WithField("host", host)
-
-	index, err := config.GetIndex(time.Now().UTC())
-	if err != nil {
-		log.Errorf("Failed to parse index from string %s", config.Index)
-		return
-	}
 	log = log.WithField("index", index)
 
 	// build the payload
@@ -102,9 +203,11 @@ func sendToES(config *conf.ElasticConfig, log *logrus.Entry, stats *stats.Counte
 	buff.Reset()
 	defer pool.Put(buff)
 
+	// only the messages that made it into the request line up with the items in the response
+	sent := make([]messaging.Message, 0, len(batch))
 	for _, in := range batch {
 		// serialize the payload
-		asBytes, err := json.Marshal(in)
+		asBytes, err := json.Marshal(in.Payload)
 		if err == nil {
 			// we don't have to specify the _index || _type b/c we are going to
 			// encode that in the URL. Hence the simple index command
@@ -112,23 +215,41 @@ func sendToES(config *conf.ElasticConfig, log *logrus.Entry, stats *stats.Counte
 			buff.WriteRune('\n')
 			buff.Write(asBytes)
 			buff.WriteRune('\n')
+			sent = append(sent, in)
 		} else {
 			log.WithError(err).Warn("Failed to marshal the input")
+			stats.IncrementErrors("marshal", 1)
+			in.Finish(messaging.IndexResult{Index: index, Err: err})
 		}
 	}
 
 	// http://<HOST>:<PORT>/_index/_type -- encode the index and type here so we don't
 	// send it in the body with each batch
-	endpoint := fmt.Sprintf("http://%s:%d/%s/%s/_bulk", host, config.Port, index, config.Type)
+	endpoint := fmt.Sprintf("http://%s:%d/%s/%s/_bulk", host, config.Port, url.PathEscape(index), url.PathEscape(config.Type))
 	stats.IncrementBatchesSent()
 	stats.IncrementMessagesSent(int64(len(batch)))
+	size := buff.Len()
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, buff)
+	if err != nil {
+		log.WithError(err).WithField("endpoint", endpoint).Warn("Failed to build the request")
+		stats.IncrementBatchesFailed()
+		stats.IncrementErrors("request", int64(len(sent)))
+		finishAll(sent, index, err, false)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	config.Authorize(req)
 
 	start := time.Now()
-	resp, err := client.Post(endpoint, "text/plain", buff)
+	resp, err := client.Do(req)
 	elapsed := time.Since(start)
+	stats.ObserveBulk(host, elapsed, size, len(sent))
 	if err != nil {
 		log.WithError(err).WithField("endpoint", endpoint).Warn("Failed to post to elasticsearch")
 		stats.IncrementBatchesFailed()
+		stats.IncrementErrors("connection", int64(len(sent)))
+		finishAll(sent, index, err, true)
 		return
 	}
 
@@ -136,14 +257,19 @@ func sendToES(config *conf.ElasticConfig, log *logrus.Entry, stats *stats.Counte
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.WithError(err).Warn("Failed to read the response body")
+		stats.IncrementErrors("response", int64(len(sent)))
+		finishAll(sent, index, err, true)
 		return
 	}
 
 	if resp.StatusCode != 200 {
 		log.Warnf("Failed to post batch: %s", string(body))
 		stats.IncrementBatchesFailed()
+		stats.IncrementErrors(fmt.Sprintf("status_%d", resp.StatusCode), int64(len(sent)))
+		finishAll(sent, index, fmt.Errorf("Elasticsearch responded with status %d", resp.StatusCode), retryableStatus(resp.StatusCode))
 		return
 	}
+	stats.BulkSucceeded()
 
 	completeLog := log.WithFields(logrus.Fields{
 		"index":       index,
@@ -152,13 +278,19 @@ func sendToES(config *conf.ElasticConfig, log *logrus.Entry, stats *stats.Counte
 		"status_code": resp.StatusCode,
 	})
 
-	if len(body) != 0 {
+	indexed := time.Now()
+	if len(body) == 0 {
+		stats.ObserveLag(host, lags(sent, indexed)...)
+		finishAll(sent, index, nil, false)
+	} else {
 		// responds with json always - let's check for errors in it
 		type response struct {
 			Errors bool `json:"errors"`
 			Items  []struct {
 				Index struct {
-					Error string `json:"error"`
+					ID     string          `json:"_id"`
+					Status int             `json:"status"`
+					Error  json.RawMessage `json:"error"`
 				} `json:"index"`
 			} `json:"items"`
 		}
@@ -166,16 +298,40 @@ func sendToES(config *conf.ElasticConfig, log *logrus.Entry, stats *stats.Counte
 		err = json.Unmarshal(body, parsed)
 		if err != nil {
 			completeLog.WithError(err).Warnf("Failed to parse the response body: %s", string(body))
+			stats.IncrementErrors("response", int64(len(sent)))
+			finishAll(sent, index, err, true)
 			return
 		}
 
+		succeeded := make([]messaging.Message, 0, len(sent))
+		for i, in := range sent {
+			res := messaging.IndexResult{Index: index}
+			if i < len(parsed.Items) {
+				item := parsed.Items[i].Index
+				res.ID = item.ID
+				if msg := itemError(item.Error); msg != "" {
+					res.Err = errors.New(msg)
+					res.Retryable = retryableStatus(item.Status)
+				}
+			}
+			if res.Err == nil {
+				succeeded = append(succeeded, in)
+			}
+			in.Finish(res)
+		}
+		stats.ObserveLag(host, lags(succeeded, indexed)...)
+
 		if parsed.Errors {
 			// we had some errors - lets collect them and let people know
 			stats.IncrementBatchesFailed()
 
 			errs := make(map[string]int)
 			for _, item := range parsed.Items {
-				errs[item.Index.Error] = errs[item.Index.Error] + 1
+				msg := itemError(item.Index.Error)
+				errs[msg] = errs[msg] + 1
+				if msg != "" {
+					stats.IncrementErrors(errorType(item.Index.Error), 1)
+				}
 			}
 
 			// make the empty error more obvious
@@ -208,3 +364,63 @@ func sendToES(config *conf.ElasticConfig, log *logrus.Entry, stats *stats.Counte
 		"elapsed": elapsed,
 	}).Debugf("Completed post in %s", elapsed)
 }
+
+// lags are how long ago each message was received
+func lags(batch []messaging.Message, indexed time.Time) []time.Duration {
+	lags := make([]time.Duration, 0, len(batch))
+	for _, in := range batch {
+		if !in.Received.IsZero() {
+			lags = append(lags, indexed.Sub(in.Received))
+		}
+	}
+	return lags
+}
+
+// itemError turns the error of a bulk item into a string. Older versions of
+// elasticsearch use a string, newer ones an object.
+func itemError(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+
+	var msg string
+	if err := json.Unmarshal(raw, &msg); err == nil {
+		return msg
+	}
+	return string(raw)
+}
+
+// errorType is the type of the error of a bulk item, e.g. 'mapper_parsing_exception'.
+// Older versions of elasticsearch only have a message like 'MapperParsingException[...]'.
+func errorType(raw json.RawMessage) string {
+	var detail struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &detail); err == nil && detail.Type != "" {
+		return detail.Type
+	}
+
+	var msg string
+	if err := json.Unmarshal(raw, &msg); err == nil {
+		if i := strings.Index(msg, "["); i > 0 {
+			return strings.TrimSpace(msg[:i])
+		}
+	}
+	return "unknown"
+}
+
+// retryableStatus is true for the statuses where sending the same documents
+// again later might work
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+func finishAll(batch []messaging.Message, index string, err error, retryable bool) {
+	for _, in := range batch {
+		in.Finish(messaging.IndexResult{
+			Index:     index,
+			Err:       err,
+			Retryable: retryable,
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -19,10 +20,6 @@ import (
 )
 
 var testLog = logrus.StandardLogger().WithField("testing", true)
-var goodResponse = &http.Response{
-	Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errors": false}`)),
-	StatusCode: 200,
-}
 var loads = []messaging.Payload{
 	{"something": "borrowed"},
 	{"something": "blue"},
@@ -51,26 +48,136 @@ func TestSendOnBatchSize(t *testing.T) {
 	validateStats(t, stats, 1, 3, 0)
 }
 
+func TestSendOnShutdown(t *testing.T) {
+	config := getConfig()
+	config.BatchSize = 10
+	config.BatchTimeoutSec = 60
+
+	reqChan := make(chan *http.Request, 1)
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		reqChan <- r
+		return goodResponse(), nil
+	})
+
+	in := make(chan messaging.Message, len(loads))
+	stats := new(stats.Counters)
+	batcher := BatchAndSend(config, in, stats, testLog)
+
+	// these are still buffered when it is told to shut down
+	for _, m := range messages(loads) {
+		in <- m
+	}
+	batcher.Shutdown()
+
+	select {
+	case req := <-reqChan:
+		assert.NotNil(t, req)
+	case <-time.After(2 * time.Second):
+		assert.FailNow(t, "timed out waiting for request")
+	}
+
+	validateStats(t, stats, 1, len(loads), 0)
+}
+
+func TestShutdownWaitsForSending(t *testing.T) {
+	config := getConfig()
+	config.BatchSize = 1
+
+	release := make(chan bool)
+	sending := make(chan bool, 1)
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		sending <- true
+		<-release
+		return goodResponse(), nil
+	})
+
+	in := make(chan messaging.Message)
+	stats := new(stats.Counters)
+	batcher := BatchAndSend(config, in, stats, testLog)
+	in <- messages(loads[:1])[0]
+	<-sending
+
+	done := make(chan bool)
+	go func() {
+		batcher.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		assert.FailNow(t, "shut down while a batch was still being sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		assert.FailNow(t, "timed out waiting for the shutdown")
+	}
+	validateStats(t, stats, 1, 1, 0)
+}
+
+func TestFlushAndSetBatching(t *testing.T) {
+	config := getConfig()
+	config.BatchSize = 10
+	config.BatchTimeoutSec = 60
+
+	reqChan := make(chan *http.Request, 2)
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		reqChan <- r
+		return goodResponse(), nil
+	})
+
+	in := make(chan messaging.Message)
+	stats := stats.NewCounter(config)
+	batcher := BatchAndSend(config, in, stats, testLog)
+	defer batcher.Shutdown()
+
+	for _, m := range messages(loads[:2]) {
+		in <- m
+	}
+	assert.Equal(t, 2, batcher.Flush())
+	select {
+	case <-reqChan:
+	case <-time.After(2 * time.Second):
+		assert.FailNow(t, "timed out waiting for the flushed batch")
+	}
+	assert.Equal(t, 0, batcher.Flush())
+
+	// the batch is sent as soon as it is big enough
+	batcher.SetBatching(2, 30)
+	size, timeout := stats.Batching()
+	assert.Equal(t, 2, size)
+	assert.Equal(t, 30, timeout)
+	for _, m := range messages(loads[:2]) {
+		in <- m
+	}
+	select {
+	case <-reqChan:
+	case <-time.After(2 * time.Second):
+		assert.FailNow(t, "timed out waiting for the batch")
+	}
+	validateStats(t, stats, 2, 4, 0)
+}
+
 func TestErrorParsing(t *testing.T) {
 	var req *http.Request
 	config := getConfig()
-	client.Transport = testTransport{
-		delegate: func(r *http.Request) (*http.Response, error) {
-			req = r
-			response := `{"errors": true, "items":[{"index": {"error": "this is an error"}}]}`
-			badResponse := &http.Response{
-				Body: ioutil.NopCloser(bytes.NewBufferString(response)),
-				// sometimes ES returns a 200, but with error strings
-				StatusCode: 200,
-				Header:     http.Header{},
-			}
-			badResponse.Header.Set("Content-Type", "application/json")
-			return badResponse, nil
-		},
-	}
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		req = r
+		response := `{"errors": true, "items":[{"index": {"error": "this is an error"}}]}`
+		badResponse := &http.Response{
+			Body: ioutil.NopCloser(bytes.NewBufferString(response)),
+			// sometimes ES returns a 200, but with error strings
+			StatusCode: 200,
+			Header:     http.Header{},
+		}
+		badResponse.Header.Set("Content-Type", "application/json")
+		return badResponse, nil
+	})
 
 	stats := new(stats.Counters)
-	sendToES(config, testLog, stats, loads)
+	sendToES(config, testLog, stats, messages(loads))
 
 	assert.NotNil(t, req)
 	validateStats(t, stats, 1, 4, 1)
@@ -80,46 +187,50 @@ func TestSendBatchMessageIsOk(t *testing.T) {
 	var req *http.Request
 	config := getConfig()
 	stats := stats.NewCounter(config)
-	client.Transport = testTransport{
-		delegate: func(r *http.Request) (*http.Response, error) {
-			req = r
-			return goodResponse, nil
-		},
-	}
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		req = r
+		return goodResponse(), nil
+	})
 
-	sendToES(config, testLog, stats, loads)
+	sendToES(config, testLog, stats, messages(loads))
 
 	assert.NotNil(t, req)
 	assert.Equal(t, "/quotes/log_line/_bulk", req.URL.Path)
 	validateStats(t, stats, 1, 4, 0)
 	validatePayload(t, req.Body, loads)
+
+	lastBulk, lastSuccess := stats.LastBulk()
+	assert.False(t, lastBulk.IsZero())
+	assert.False(t, lastSuccess.IsZero())
 }
 
 func TestErrorStatus(t *testing.T) {
 	var req *http.Request
 	config := getConfig()
 	stats := stats.NewCounter(config)
-	client.Transport = testTransport{
-		delegate: func(r *http.Request) (*http.Response, error) {
-			req = r
-			badResponse := &http.Response{
-				Body:       ioutil.NopCloser(bytes.NewBufferString("something")),
-				StatusCode: 500,
-			}
-			return badResponse, nil
-		},
-	}
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		req = r
+		badResponse := &http.Response{
+			Body:       ioutil.NopCloser(bytes.NewBufferString("something")),
+			StatusCode: 500,
+		}
+		return badResponse, nil
+	})
 
-	sendToES(config, testLog, stats, loads)
+	sendToES(config, testLog, stats, messages(loads))
 
 	assert.NotNil(t, req)
 	validateStats(t, stats, 1, 4, 1)
+
+	lastBulk, lastSuccess := stats.LastBulk()
+	assert.False(t, lastBulk.IsZero())
+	assert.True(t, lastSuccess.IsZero())
 }
 
 func TestMissingClient(t *testing.T) {
 	config := getConfig()
 	stats := new(stats.Counters)
-	sendToES(config, testLog, stats, []messaging.Payload{})
+	sendToES(config, testLog, stats, []messaging.Message{})
 
 	validateStats(t, stats, 0, 0, 0)
 }
@@ -128,13 +239,11 @@ func TestSkipEmpties(t *testing.T) {
 	config := getConfig()
 	stats := new(stats.Counters)
 
-	client.Transport = testTransport{
-		delegate: func(r *http.Request) (*http.Response, error) {
-			assert.FailNow(t, "Shouldn't have sent anything")
-			return nil, nil
-		},
-	}
-	sendToES(config, testLog, stats, []messaging.Payload{})
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		assert.FailNow(t, "Shouldn't have sent anything")
+		return nil, nil
+	})
+	sendToES(config, testLog, stats, []messaging.Message{})
 
 	validateStats(t, stats, 0, 0, 0)
 }
@@ -145,29 +254,179 @@ func TestIndexFormatIsRespected(t *testing.T) {
 
 	config.Index = "test_{{.Year}}_{{.Month}}_{{.Day}}"
 	now := time.Now().UTC()
-	client.Transport = testTransport{
-		delegate: func(r *http.Request) (*http.Response, error) {
-			dateString := strings.ToLower(fmt.Sprintf("test_%d_%s_%d", now.Year(), now.Month(), now.Day()))
-			assert.Equal(t, "/"+dateString+"/log_line/_bulk", r.URL.Path)
-			return goodResponse, nil
-		},
-	}
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		dateString := strings.ToLower(fmt.Sprintf("test_%d_%s_%d", now.Year(), now.Month(), now.Day()))
+		assert.Equal(t, "/"+dateString+"/log_line/_bulk", r.URL.Path)
+		return goodResponse(), nil
+	})
 
-	sendToES(config, testLog, stats, loads)
+	sendToES(config, testLog, stats, messages(loads))
 }
 
 func TestBadFormatForIndex(t *testing.T) {
 	config := getConfig()
 	config.Index = "test_{{if }}"
 	stats := new(stats.Counters)
-	client.Transport = testTransport{
-		delegate: func(r *http.Request) (*http.Response, error) {
-			assert.FailNow(t, "shouldn't have sent anything")
-			return nil, nil
-		},
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		assert.FailNow(t, "shouldn't have sent anything")
+		return nil, nil
+	})
+
+	sendToES(config, testLog, stats, messages(loads))
+}
+
+func TestIndexFromFields(t *testing.T) {
+	config := getConfig()
+	config.Index = "logs_{{.Fields.env}}"
+	stats := new(stats.Counters)
+
+	paths := make(map[string]int)
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		paths[r.URL.Path]++
+		return goodResponse(), nil
+	})
+
+	sendToES(config, testLog, stats, messages([]messaging.Payload{
+		{"env": "prod"},
+		{"env": "staging"},
+		{"env": "prod"},
+	}))
+
+	assert.Equal(t, map[string]int{
+		"/logs_prod/log_line/_bulk":    1,
+		"/logs_staging/log_line/_bulk": 1,
+	}, paths)
+	validateStats(t, stats, 2, 3, 0)
+}
+
+func TestIndexFromMissingField(t *testing.T) {
+	config := getConfig()
+	config.Index = "logs_{{.Fields.env}}"
+	stats := new(stats.Counters)
+
+	paths := make(map[string]int)
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		paths[r.URL.Path]++
+		return goodResponse(), nil
+	})
+
+	results := make([]messaging.IndexResult, 2)
+	batch := []messaging.Message{}
+	for i, payload := range []messaging.Payload{{"env": "prod"}, {"level": "info"}} {
+		i := i
+		batch = append(batch, messaging.NewMessage(payload, func(res messaging.IndexResult) {
+			results[i] = res
+		}))
 	}
+	sendToES(config, testLog, stats, batch)
 
-	sendToES(config, testLog, stats, loads)
+	assert.Equal(t, map[string]int{"/logs_prod/log_line/_bulk": 1}, paths)
+	assert.Nil(t, results[0].Err)
+	assert.NotNil(t, results[1].Err)
+	assert.EqualValues(t, 1, stats.Errors()["index_template"])
+}
+
+func TestIndexFromMaliciousField(t *testing.T) {
+	config := getConfig()
+	config.Index = "logs_{{.Fields.env}}"
+	stats := new(stats.Counters)
+
+	paths := make(map[string]int)
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		paths[r.URL.EscapedPath()]++
+		return goodResponse(), nil
+	})
+
+	results := make([]messaging.IndexResult, 2)
+	batch := []messaging.Message{}
+	for i, payload := range []messaging.Payload{{"env": "prod"}, {"env": "x/log/_delete_by_query?q=*#"}} {
+		i := i
+		batch = append(batch, messaging.NewMessage(payload, func(res messaging.IndexResult) {
+			results[i] = res
+		}))
+	}
+	sendToES(config, testLog, stats, batch)
+
+	assert.Equal(t, map[string]int{"/logs_prod/log_line/_bulk": 1}, paths)
+	assert.Nil(t, results[0].Err)
+	assert.NotNil(t, results[1].Err)
+	assert.EqualValues(t, 1, stats.Errors()["index_template"])
+}
+
+func TestResultsPerDocument(t *testing.T) {
+	config := getConfig()
+	stats := new(stats.Counters)
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		response := `{"errors": true, "items":[
+			{"index": {"_id": "1", "status": 201}},
+			{"index": {"_id": "2", "status": 400, "error": {"type": "mapper_parsing_exception"}}},
+			{"index": {"_id": "3", "status": 429, "error": "rejected"}}
+		]}`
+		return &http.Response{
+			Body:       ioutil.NopCloser(bytes.NewBufferString(response)),
+			StatusCode: 200,
+		}, nil
+	})
+
+	results := make([]messaging.IndexResult, 3)
+	batch := []messaging.Message{}
+	for i := range results {
+		i := i
+		batch = append(batch, messaging.NewMessage(messaging.Payload{"n": i}, func(res messaging.IndexResult) {
+			results[i] = res
+		}))
+	}
+	sendToES(config, testLog, stats, batch)
+
+	assert.Equal(t, messaging.IndexResult{ID: "1", Index: "quotes"}, results[0])
+	assert.Equal(t, "2", results[1].ID)
+	assert.EqualError(t, results[1].Err, `{"type": "mapper_parsing_exception"}`)
+	assert.False(t, results[1].Retryable)
+	assert.EqualError(t, results[2].Err, "rejected")
+	assert.True(t, results[2].Retryable)
+
+	assert.Equal(t, map[string]int64{"mapper_parsing_exception": 1, "unknown": 1}, stats.Errors())
+
+	// only the document that was indexed counts towards the lag
+	hosts := stats.HostStats()
+	if assert.Len(t, hosts, 1) {
+		for host, summary := range hosts {
+			assert.Contains(t, config.Hosts, host)
+			assert.EqualValues(t, 1, summary.Bulks)
+			assert.True(t, summary.Docs.P50 > 1 && summary.Docs.P50 <= 5)
+			assert.True(t, summary.Bytes.P99 > 0)
+			assert.True(t, summary.LagSec.P50 > 0)
+		}
+	}
+}
+
+func TestResultsWhenPostFails(t *testing.T) {
+	config := getConfig()
+	stats := new(stats.Counters)
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			Body:       ioutil.NopCloser(bytes.NewBufferString("unavailable")),
+			StatusCode: 503,
+		}, nil
+	})
+
+	results := []messaging.IndexResult{}
+	sendToES(config, testLog, stats, []messaging.Message{
+		messaging.NewMessage(messaging.Payload{"n": 1}, func(res messaging.IndexResult) {
+			results = append(results, res)
+		}),
+	})
+
+	assert.Len(t, results, 1)
+	assert.NotNil(t, results[0].Err)
+	assert.True(t, results[0].Retryable)
+	assert.Equal(t, map[string]int64{"status_503": 1}, stats.Errors())
+}
+
+func TestErrorType(t *testing.T) {
+	assert.Equal(t, "mapper_parsing_exception", errorType(json.RawMessage(`{"type": "mapper_parsing_exception", "reason": "failed to parse"}`)))
+	assert.Equal(t, "MapperParsingException", errorType(json.RawMessage(`"MapperParsingException[failed to parse [date]]"`)))
+	assert.Equal(t, "unknown", errorType(json.RawMessage(`"rejected"`)))
 }
 
 // --------------------------------------------------------------------------------------------------------------------
@@ -184,33 +443,56 @@ func getConfig() *conf.ElasticConfig {
 	return &c
 }
 
-type testTransport struct {
-	delegate func(*http.Request) (*http.Response, error)
+// the transport is set once, batchers that are still running from an earlier
+// test would race with changing it
+func init() {
+	client.Transport = testTransport{}
 }
 
+var (
+	delegateMu sync.Mutex
+	delegate   func(*http.Request) (*http.Response, error)
+)
+
+type testTransport struct{}
+
 func (tt testTransport) RoundTrip(r *http.Request) (*http.Response, error) {
-	return tt.delegate(r)
+	delegateMu.Lock()
+	d := delegate
+	delegateMu.Unlock()
+	return d(r)
+}
+
+// respondWith changes how the requests of the following sends are answered
+func respondWith(d func(*http.Request) (*http.Response, error)) {
+	delegateMu.Lock()
+	delegate = d
+	delegateMu.Unlock()
+}
+
+// goodResponse is a new response each time, the client closes its body
+func goodResponse() *http.Response {
+	return &http.Response{
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errors": false}`)),
+		StatusCode: 200,
+	}
 }
 
 func sendAndSuch(t *testing.T, config *conf.ElasticConfig, payloads []messaging.Payload) *stats.Counters {
 	reqChan := make(chan *http.Request)
-	client.Transport = testTransport{
-		delegate: func(r *http.Request) (*http.Response, error) {
-			reqChan <- r
-			return goodResponse, nil
-		},
-	}
+	respondWith(func(r *http.Request) (*http.Response, error) {
+		reqChan <- r
+		return goodResponse(), nil
+	})
 
-	in := make(chan messaging.Payload)
+	in := make(chan messaging.Message)
 	stats := new(stats.Counters)
 
-	shutdown := BatchAndSend(config, in, stats, testLog)
-	defer func() {
-		shutdown <- true
-	}()
+	// it isn't shut down, that would send on what is left of the batch
+	BatchAndSend(config, in, stats, testLog)
 
-	for _, p := range payloads {
-		in <- p
+	for _, m := range messages(payloads) {
+		in <- m
 	}
 
 	// have to do it this way b/c otherwise it is a race
@@ -231,6 +513,14 @@ func validateStats(t *testing.T, stats *stats.Counters, batchesSent, linesSent,
 	assert.EqualValues(t, linesSent, stats.MessagesSent)
 }
 
+func messages(payloads []messaging.Payload) []messaging.Message {
+	msgs := []messaging.Message{}
+	for _, p := range payloads {
+		msgs = append(msgs, messaging.NewMessage(p, nil))
+	}
+	return msgs
+}
+
 func validatePayload(t *testing.T, body io.ReadCloser, payloads []messaging.Payload) {
 	assert.NotNil(t, body)
 
@@ -0,0 +1,124 @@
+package enrich
+
+import (
+	"os"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/netlify/elastinats/messaging"
+)
+
+// Config describes the fields that are added to each payload
+type Config struct {
+	// Static fields are added as is to every payload
+	Static map[string]string `mapstructure:"static"         json:"static"         desc:"Fields that are added as is to every payload"`
+
+	// HostnameField and VersionField are where the hostname and version of this
+	// elastinats instance are written to. They're skipped if empty.
+	HostnameField string `mapstructure:"hostname_field" json:"hostname_field" desc:"The field the hostname is written to, skipped if empty"`
+	VersionField  string `mapstructure:"version_field"  json:"version_field"  desc:"The field the elastinats version is written to, skipped if empty"`
+
+	Lookups []LookupConfig `mapstructure:"lookups" json:"lookups" desc:"Tables that fields are looked up in"`
+	GeoIP   *GeoIPConfig   `mapstructure:"geoip"   json:"geoip"   desc:"Adds the location of IP fields"`
+}
+
+// Enricher adds the static and looked up fields to payloads
+type Enricher struct {
+	static  map[string]interface{}
+	lookups []*lookupTable
+	geo     *geoIP
+}
+
+// NewEnricher will load all the lookup tables and start watching them for changes
+func NewEnricher(config *Config, version string, log *logrus.Entry) (*Enricher, error) {
+	e := &Enricher{
+		static: make(map[string]interface{}),
+	}
+
+	for k, v := range config.Static {
+		e.static[k] = v
+	}
+
+	if config.HostnameField != "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		e.static[config.HostnameField] = hostname
+	}
+
+	if config.VersionField != "" {
+		e.static[config.VersionField] = version
+	}
+
+	for i := range config.Lookups {
+		table, err := newLookupTable(&config.Lookups[i], log)
+		if err != nil {
+			e.Close()
+			return nil, err
+		}
+		e.lookups = append(e.lookups, table)
+	}
+
+	if config.GeoIP != nil {
+		geo, err := newGeoIP(config.GeoIP, log)
+		if err != nil {
+			e.Close()
+			return nil, err
+		}
+		e.geo = geo
+	}
+
+	return e, nil
+}
+
+// Enrich will add the fields to the payload. Fields already in the payload
+// are overwritten.
+func (e *Enricher) Enrich(p messaging.Payload) {
+	for k, v := range e.static {
+		p[k] = v
+	}
+
+	for _, table := range e.lookups {
+		table.enrich(p)
+	}
+
+	if e.geo != nil {
+		e.geo.enrich(p)
+	}
+}
+
+// Close stops watching the lookup tables and databases for changes
+func (e *Enricher) Close() {
+	for _, table := range e.lookups {
+		table.close()
+	}
+
+	if e.geo != nil {
+		e.geo.close()
+	}
+}
+
+// copyValue deep copies the maps and slices of a value, so that the payloads
+// that get it can be changed without changing each other or the source
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return copyMap(t)
+	case []interface{}:
+		copied := make([]interface{}, len(t))
+		for i, child := range t {
+			copied[i] = copyValue(child)
+		}
+		return copied
+	}
+	return v
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		copied[k] = copyValue(v)
+	}
+	return copied
+}
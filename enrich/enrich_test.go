@@ -0,0 +1,139 @@
+package enrich
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/elastinats/messaging"
+)
+
+var testLog = logrus.StandardLogger().WithField("testing", true)
+
+func TestStaticFields(t *testing.T) {
+	e, err := NewEnricher(&Config{
+		Static:        map[string]string{"region": "us-east-1"},
+		HostnameField: "elastinats_host",
+		VersionField:  "elastinats_version",
+	}, "abc123", testLog)
+	assert.Nil(t, err)
+	defer e.Close()
+
+	hostname, _ := os.Hostname()
+	p := messaging.Payload{"msg": "hi"}
+	e.Enrich(p)
+
+	assert.Equal(t, messaging.Payload{
+		"msg":                "hi",
+		"region":             "us-east-1",
+		"elastinats_host":    hostname,
+		"elastinats_version": "abc123",
+	}, p)
+}
+
+func TestCSVLookup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "services.csv", "service,team,owner\napi,platform,alice\nweb,frontend,bob\n")
+	e, err := NewEnricher(&Config{
+		Lookups: []LookupConfig{{File: path, KeyField: "service"}},
+	}, "", testLog)
+	assert.Nil(t, err)
+	defer e.Close()
+
+	p := messaging.Payload{"service": "api"}
+	e.Enrich(p)
+	assert.Equal(t, messaging.Payload{"service": "api", "team": "platform", "owner": "alice"}, p)
+
+	p = messaging.Payload{"service": "unknown"}
+	e.Enrich(p)
+	assert.Equal(t, messaging.Payload{"service": "unknown"}, p)
+}
+
+func TestJSONLookupWithTarget(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "services.json", `{"api": {"team": "platform", "tier": 1}}`)
+	e, err := NewEnricher(&Config{
+		Lookups: []LookupConfig{{File: path, KeyField: "service", TargetField: "service_info"}},
+	}, "", testLog)
+	assert.Nil(t, err)
+	defer e.Close()
+
+	p := messaging.Payload{"service": "api"}
+	e.Enrich(p)
+	assert.Equal(t, map[string]interface{}{"team": "platform", "tier": float64(1)}, p["service_info"])
+}
+
+func TestLookupRowsAreCopied(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "services.json", `{"api": {"owner": {"team": {"name": "x"}}}}`)
+	for _, target := range []string{"", "service_info"} {
+		e, err := NewEnricher(&Config{
+			Lookups: []LookupConfig{{File: path, KeyField: "service", TargetField: target}},
+		}, "", testLog)
+		assert.Nil(t, err)
+
+		first := messaging.Payload{"service": "api"}
+		e.Enrich(first)
+		first.Shape(&messaging.PayloadConfig{MaxDepth: 2})
+
+		second := messaging.Payload{"service": "api"}
+		e.Enrich(second)
+		e.Close()
+
+		owner := second["owner"]
+		if target != "" {
+			owner = second[target].(map[string]interface{})["owner"]
+		}
+		assert.Equal(t, map[string]interface{}{"team": map[string]interface{}{"name": "x"}}, owner)
+	}
+}
+
+func TestLookupReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "services.csv", "service,team\napi,platform\n")
+	table, err := newLookupTable(&LookupConfig{File: path, KeyField: "service"}, testLog)
+	assert.Nil(t, err)
+	defer table.close()
+
+	writeFile(t, dir, "services.csv", "service,team\napi,infrastructure\n")
+	assert.Nil(t, table.load())
+
+	p := messaging.Payload{"service": "api"}
+	table.enrich(p)
+	assert.Equal(t, "infrastructure", p["team"])
+}
+
+func TestBadLookups(t *testing.T) {
+	_, err := NewEnricher(&Config{Lookups: []LookupConfig{{File: "services.csv"}}}, "", testLog)
+	assert.NotNil(t, err)
+
+	_, err = NewEnricher(&Config{Lookups: []LookupConfig{{File: "services.xml", KeyField: "service"}}}, "", testLog)
+	assert.NotNil(t, err)
+
+	_, err = NewEnricher(&Config{Lookups: []LookupConfig{{File: "/does/not/exist.csv", KeyField: "service"}}}, "", testLog)
+	assert.NotNil(t, err)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "enrich")
+	assert.Nil(t, err)
+	return dir
+}
+
+func writeFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	return path
+}
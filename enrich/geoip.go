@@ -0,0 +1,236 @@
+package enrich
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/oschwald/maxminddb-golang"
+
+	"github.com/netlify/elastinats/messaging"
+	"github.com/netlify/elastinats/watch"
+)
+
+const (
+	defaultGeoCacheSize = 10000
+	defaultGeoSuffix    = "_geo"
+)
+
+// GeoIPConfig describes how IP fields of a payload are mapped to locations
+// with a local MaxMind database. For each IP field an object is written to
+// '<field>_geo' with a 'location' that can be mapped as a geo_point in
+// elasticsearch, and the country, city and ASN information that is available.
+type GeoIPConfig struct {
+	// Database is a City or Country .mmdb file
+	Database string `mapstructure:"database"      json:"database"      desc:"A City or Country .mmdb file"`
+
+	// ASNDatabase is an optional ASN .mmdb file
+	ASNDatabase string `mapstructure:"asn_database"  json:"asn_database"  desc:"An optional ASN .mmdb file"`
+
+	// Fields are the payload fields that hold the IPs
+	Fields []string `mapstructure:"fields"        json:"fields"        desc:"The payload fields that hold the IPs"`
+
+	// TargetSuffix is appended to the IP field name to build the target field, defaults to '_geo'
+	TargetSuffix string `mapstructure:"target_suffix" json:"target_suffix" desc:"Appended to the IP field name to build the target field" default:"_geo"`
+
+	// CacheSize is the number of IPs whose results are kept, defaults to 10000
+	CacheSize int `mapstructure:"cache_size"    json:"cache_size"    desc:"The number of IPs whose results are kept" default:"10000"`
+
+	// ReloadSec is how often the database files are checked for changes, defaults to 30
+	ReloadSec int `mapstructure:"reload_sec"    json:"reload_sec"    desc:"How often the database files are checked for changes, in seconds" default:"30"`
+}
+
+type cityRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+type geoIP struct {
+	config *GeoIPConfig
+	suffix string
+	cache  *lru
+	city   *mmdb
+	asn    *mmdb
+}
+
+func newGeoIP(config *GeoIPConfig, log *logrus.Entry) (*geoIP, error) {
+	if config.Database == "" && config.ASNDatabase == "" {
+		return nil, errors.New("GeoIP needs at least one of database or asn_database")
+	}
+	if len(config.Fields) == 0 {
+		return nil, errors.New("GeoIP needs at least one field to look up")
+	}
+
+	g := &geoIP{
+		config: config,
+		suffix: config.TargetSuffix,
+	}
+	if g.suffix == "" {
+		g.suffix = defaultGeoSuffix
+	}
+
+	size := config.CacheSize
+	if size <= 0 {
+		size = defaultGeoCacheSize
+	}
+	g.cache = newLRU(size)
+
+	var err error
+	if config.Database != "" {
+		if g.city, err = openMMDB(config.Database, config.ReloadSec, g.cache.purge, log); err != nil {
+			return nil, err
+		}
+	}
+	if config.ASNDatabase != "" {
+		if g.asn, err = openMMDB(config.ASNDatabase, config.ReloadSec, g.cache.purge, log); err != nil {
+			g.close()
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+func (g *geoIP) enrich(p messaging.Payload) {
+	for _, field := range g.config.Fields {
+		raw, ok := p[field].(string)
+		if !ok {
+			continue
+		}
+
+		result, ok := g.cache.get(raw)
+		if !ok {
+			result = g.lookup(raw)
+			g.cache.add(raw, result)
+		}
+
+		// the cached result is shared, the payload gets its own copy
+		if result != nil {
+			p[field+g.suffix] = copyMap(result)
+		}
+	}
+}
+
+func (g *geoIP) lookup(raw string) map[string]interface{} {
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		return nil
+	}
+
+	result := make(map[string]interface{})
+	if g.city != nil {
+		rec := new(cityRecord)
+		if err := g.city.lookup(ip, rec); err == nil {
+			if rec.Location.Latitude != 0 || rec.Location.Longitude != 0 {
+				result["location"] = map[string]interface{}{
+					"lat": rec.Location.Latitude,
+					"lon": rec.Location.Longitude,
+				}
+			}
+			setIfNotEmpty(result, "country_iso_code", rec.Country.ISOCode)
+			setIfNotEmpty(result, "country_name", rec.Country.Names["en"])
+			setIfNotEmpty(result, "city_name", rec.City.Names["en"])
+		}
+	}
+
+	if g.asn != nil {
+		rec := new(asnRecord)
+		if err := g.asn.lookup(ip, rec); err == nil && rec.Number != 0 {
+			result["asn"] = rec.Number
+			setIfNotEmpty(result, "as_org", rec.Organization)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func (g *geoIP) close() {
+	if g.city != nil {
+		g.city.close()
+	}
+	if g.asn != nil {
+		g.asn.close()
+	}
+}
+
+func setIfNotEmpty(m map[string]interface{}, key, value string) {
+	if value != "" {
+		m[key] = value
+	}
+}
+
+// mmdb wraps a reader so that it can be swapped out when the file changes
+type mmdb struct {
+	path     string
+	onReload func()
+	shutdown chan bool
+
+	mu     sync.RWMutex
+	reader *maxminddb.Reader
+}
+
+func openMMDB(path string, reloadSec int, onReload func(), log *logrus.Entry) (*mmdb, error) {
+	db := &mmdb{
+		path:     path,
+		onReload: onReload,
+		shutdown: make(chan bool),
+	}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+
+	go watch.File(path, reloadSec, db.load, log.WithField("geoip_database", path), db.shutdown)
+
+	return db, nil
+}
+
+func (db *mmdb) load() error {
+	reader, err := maxminddb.Open(db.path)
+	if err != nil {
+		return fmt.Errorf("Failed to open GeoIP database %s: %v", db.path, err)
+	}
+
+	db.mu.Lock()
+	old := db.reader
+	db.reader = reader
+	db.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+		db.onReload()
+	}
+	return nil
+}
+
+func (db *mmdb) lookup(ip net.IP, result interface{}) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.reader.Lookup(ip, result)
+}
+
+func (db *mmdb) close() {
+	close(db.shutdown)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.reader.Close()
+}
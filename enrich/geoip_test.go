@@ -0,0 +1,120 @@
+package enrich
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/elastinats/messaging"
+)
+
+func TestLRUEvictsOldest(t *testing.T) {
+	c := newLRU(2)
+	c.add("a", map[string]interface{}{"v": 1})
+	c.add("b", map[string]interface{}{"v": 2})
+
+	// touch a so that b is the oldest
+	_, ok := c.get("a")
+	assert.True(t, ok)
+
+	c.add("c", map[string]interface{}{"v": 3})
+
+	_, ok = c.get("b")
+	assert.False(t, ok)
+	v, ok := c.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v["v"])
+
+	c.purge()
+	_, ok = c.get("a")
+	assert.False(t, ok)
+}
+
+func TestGeoIPRequiresDatabaseAndFields(t *testing.T) {
+	_, err := newGeoIP(&GeoIPConfig{Fields: []string{"client_ip"}}, testLog)
+	assert.NotNil(t, err)
+
+	_, err = newGeoIP(&GeoIPConfig{Database: "GeoLite2-City.mmdb"}, testLog)
+	assert.NotNil(t, err)
+
+	_, err = newGeoIP(&GeoIPConfig{Database: "/does/not/exist.mmdb", Fields: []string{"client_ip"}}, testLog)
+	assert.NotNil(t, err)
+}
+
+func TestGeoIPResultsAreCopied(t *testing.T) {
+	g := &geoIP{
+		config: &GeoIPConfig{Fields: []string{"client_ip"}},
+		suffix: defaultGeoSuffix,
+		cache:  newLRU(1),
+	}
+	g.cache.add("1.2.3.4", map[string]interface{}{
+		"location": map[string]interface{}{"lat": 1.5, "lon": 2.5},
+	})
+
+	first := messaging.Payload{"client_ip": "1.2.3.4"}
+	second := messaging.Payload{"client_ip": "1.2.3.4"}
+	g.enrich(first)
+	g.enrich(second)
+
+	first["client_ip"+defaultGeoSuffix].(map[string]interface{})["location"].(map[string]interface{})["lat"] = "changed"
+
+	assert.Equal(t, 1.5, second["client_ip"+defaultGeoSuffix].(map[string]interface{})["location"].(map[string]interface{})["lat"])
+	cached, _ := g.cache.get("1.2.3.4")
+	assert.Equal(t, 1.5, cached["location"].(map[string]interface{})["lat"])
+}
+
+// the databases in testdata are written by testdata/mmdb_gen.go
+func TestGeoIPLookup(t *testing.T) {
+	g, err := newGeoIP(&GeoIPConfig{
+		Database:    "testdata/GeoIP2-City-Test.mmdb",
+		ASNDatabase: "testdata/GeoLite2-ASN-Test.mmdb",
+		Fields:      []string{"client_ip", "server_ip", "user"},
+	}, testLog)
+	if err != nil {
+		t.Fatalf("Failed to open the databases: %v", err)
+	}
+	defer g.close()
+
+	p := messaging.Payload{
+		"client_ip": "81.2.69.160",
+		"server_ip": "89.160.20.115",
+		"user":      "not an ip",
+	}
+	g.enrich(p)
+
+	assert.Equal(t, map[string]interface{}{
+		"location":         map[string]interface{}{"lat": 51.5142, "lon": -0.0931},
+		"country_iso_code": "GB",
+		"country_name":     "United Kingdom",
+		"city_name":        "London",
+		"asn":              uint(20712),
+		"as_org":           "Andrews & Arnold Ltd",
+	}, p["client_ip_geo"])
+
+	// only what the database has for it
+	assert.Equal(t, map[string]interface{}{
+		"country_iso_code": "SE",
+		"country_name":     "Sweden",
+	}, p["server_ip_geo"])
+
+	assert.NotContains(t, p, "user_geo")
+}
+
+func TestGeoIPLookupMisses(t *testing.T) {
+	g, err := newGeoIP(&GeoIPConfig{Database: "testdata/GeoIP2-City-Test.mmdb", Fields: []string{"client_ip"}}, testLog)
+	if err != nil {
+		t.Fatalf("Failed to open the database: %v", err)
+	}
+	defer g.close()
+
+	for _, ip := range []string{"10.0.0.1", "81.2.70.1", "::1", "81.2.69"} {
+		p := messaging.Payload{"client_ip": ip}
+		g.enrich(p)
+		assert.NotContains(t, p, "client_ip_geo", ip)
+	}
+
+	// a field that isn't a string is left alone
+	p := messaging.Payload{"client_ip": 81}
+	g.enrich(p)
+	assert.Equal(t, messaging.Payload{"client_ip": 81}, p)
+}
@@ -0,0 +1,153 @@
+package enrich
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/netlify/elastinats/messaging"
+	"github.com/netlify/elastinats/watch"
+)
+
+// LookupConfig describes a table that is used to add fields to a payload based
+// on the value of one of its fields, e.g. service name -> team and owner.
+//
+// A CSV file needs a header row, the first column is the key and the others
+// are the fields that are added. A JSON file is an object of key -> object of fields.
+type LookupConfig struct {
+	File string `mapstructure:"file"         json:"file"         desc:"A CSV or JSON file with the table"`
+
+	// KeyField is the payload field whose value is looked up in the table
+	KeyField string `mapstructure:"key_field"    json:"key_field"    desc:"The payload field whose value is looked up"`
+
+	// TargetField nests the fields under this key, otherwise they're added at the top level
+	TargetField string `mapstructure:"target_field" json:"target_field" desc:"Nest the fields under this key, otherwise they're added at the top level"`
+
+	// ReloadSec is how often the file is checked for changes, defaults to 30
+	ReloadSec int `mapstructure:"reload_sec"   json:"reload_sec"   desc:"How often the file is checked for changes, in seconds" default:"30"`
+}
+
+type lookupTable struct {
+	config   *LookupConfig
+	shutdown chan bool
+
+	mu   sync.RWMutex
+	rows map[string]map[string]interface{}
+}
+
+func newLookupTable(config *LookupConfig, log *logrus.Entry) (*lookupTable, error) {
+	if config.File == "" || config.KeyField == "" {
+		return nil, errors.New("A lookup table needs both a file and a key_field")
+	}
+
+	t := &lookupTable{
+		config:   config,
+		shutdown: make(chan bool),
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+
+	go watch.File(config.File, config.ReloadSec, t.load, log.WithField("lookup_file", config.File), t.shutdown)
+
+	return t, nil
+}
+
+func (t *lookupTable) enrich(p messaging.Payload) {
+	key, ok := p[t.config.KeyField]
+	if !ok {
+		return
+	}
+
+	t.mu.RLock()
+	row, ok := t.rows[fmt.Sprint(key)]
+	t.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	// the rows are shared by every payload with the key, each gets its own copy
+	if t.config.TargetField != "" {
+		p[t.config.TargetField] = copyMap(row)
+		return
+	}
+
+	for k, v := range row {
+		p[k] = copyValue(v)
+	}
+}
+
+func (t *lookupTable) load() error {
+	var rows map[string]map[string]interface{}
+	var err error
+	switch strings.ToLower(filepath.Ext(t.config.File)) {
+	case ".csv":
+		rows, err = loadCSV(t.config.File)
+	case ".json":
+		rows, err = loadJSON(t.config.File)
+	default:
+		err = fmt.Errorf("Unsupported lookup file %s - it must be a .csv or .json file", t.config.File)
+	}
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.rows = rows
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *lookupTable) close() {
+	close(t.shutdown)
+}
+
+func loadCSV(path string) (map[string]map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("Lookup file %s is missing a header row", path)
+	}
+
+	header := records[0]
+	rows := make(map[string]map[string]interface{}, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(header)-1)
+		for i := 1; i < len(header) && i < len(record); i++ {
+			row[header[i]] = record[i]
+		}
+		rows[record[0]] = row
+	}
+
+	return rows, nil
+}
+
+func loadJSON(path string) (map[string]map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make(map[string]map[string]interface{})
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, fmt.Errorf("Failed to parse lookup file %s: %v", path, err)
+	}
+
+	return rows, nil
+}
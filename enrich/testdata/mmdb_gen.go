@@ -0,0 +1,174 @@
+//go:build ignore
+// +build ignore
+
+// mmdb_gen writes the small MaxMind databases that the GeoIP tests use, in the
+// format described at https://maxmind.github.io/MaxMind-DB/. Run it from this
+// directory with 'go run mmdb_gen.go'.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+type network struct {
+	cidr string
+	data map[string]interface{}
+}
+
+func main() {
+	write("GeoIP2-City-Test.mmdb", "GeoIP2-City", []network{
+		{"81.2.69.0/24", map[string]interface{}{
+			"city":     map[string]interface{}{"names": map[string]interface{}{"en": "London"}},
+			"country":  map[string]interface{}{"iso_code": "GB", "names": map[string]interface{}{"en": "United Kingdom"}},
+			"location": map[string]interface{}{"latitude": 51.5142, "longitude": -0.0931},
+		}},
+		{"89.160.20.112/28", map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "SE", "names": map[string]interface{}{"en": "Sweden"}},
+		}},
+	})
+	write("GeoLite2-ASN-Test.mmdb", "GeoLite2-ASN", []network{
+		{"81.2.69.0/24", map[string]interface{}{
+			"autonomous_system_number":       uint32(20712),
+			"autonomous_system_organization": "Andrews & Arnold Ltd",
+		}},
+	})
+}
+
+// write builds an IPv4 search tree with 24 bit records
+func write(path, dbType string, networks []network) {
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	data := new(bytes.Buffer)
+	leaves := map[[2]int]int{}
+
+	for _, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ip := ipNet.IP.To4()
+		bits, _ := ipNet.Mask.Size()
+
+		offset := data.Len()
+		encode(data, n.data)
+
+		node := 0
+		for i := 0; i < bits; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == bits-1 {
+				leaves[[2]int{node, bit}] = offset
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	count := len(nodes)
+	out := new(bytes.Buffer)
+	for i, node := range nodes {
+		for bit, record := range node {
+			value := count
+			if offset, ok := leaves[[2]int{i, bit}]; ok {
+				value = count + 16 + offset
+			} else if record != empty {
+				value = record
+			}
+			out.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	encode(out, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC).Unix()),
+		"database_type":               dbType,
+		"description":                 map[string]interface{}{"en": "Test data for elastinats"},
+		"ip_version":                  uint16(4),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(24),
+	})
+
+	if err := ioutil.WriteFile(path, out.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func control(out *bytes.Buffer, typ, size int) {
+	var first byte
+	var extended []byte
+	if typ > 7 {
+		extended = []byte{byte(typ - 7)}
+	} else {
+		first = byte(typ << 5)
+	}
+
+	switch {
+	case size < 29:
+		out.WriteByte(first | byte(size))
+	case size < 285:
+		out.WriteByte(first | 29)
+		extended = append(extended, byte(size-29))
+	default:
+		out.WriteByte(first | 30)
+		extended = append(extended, byte((size-285)>>8), byte(size-285))
+	}
+	out.Write(extended)
+}
+
+func encodeUint(out *bytes.Buffer, typ int, v uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	b = bytes.TrimLeft(b, "\x00")
+	control(out, typ, len(b))
+	out.Write(b)
+}
+
+func encode(out *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		control(out, 2, len(v))
+		out.WriteString(v)
+	case float64:
+		control(out, 3, 8)
+		binary.Write(out, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		encodeUint(out, 5, uint64(v))
+	case uint32:
+		encodeUint(out, 6, uint64(v))
+	case uint64:
+		encodeUint(out, 9, v)
+	case []interface{}:
+		control(out, 11, len(v))
+		for _, item := range v {
+			encode(out, item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		control(out, 7, len(v))
+		for _, key := range keys {
+			encode(out, key)
+			encode(out, v[key])
+		}
+	default:
+		log.Fatalf("Can't encode %T", v)
+	}
+}
@@ -0,0 +1,141 @@
+package messaging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultHeaderPrefix = "@header."
+
+	contentTypeHeader     = "Content-Type"
+	contentEncodingHeader = "Content-Encoding"
+)
+
+// HeadersConfig describes which nats headers are copied into the payload
+type HeadersConfig struct {
+	// Prefix is put in front of the header name to build the field, defaults to '@header.'
+	Prefix string `mapstructure:"prefix" json:"prefix" desc:"Put in front of the header name to build the field" default:"@header."`
+
+	// Allow lists the only headers that are copied, all of them if it is empty.
+	// Deny lists headers that are never copied. Both are case insensitive.
+	Allow []string `mapstructure:"allow"  json:"allow"  desc:"The only headers that are copied, all of them if empty"`
+	Deny  []string `mapstructure:"deny"   json:"deny"   desc:"Headers that are never copied"`
+}
+
+// MaxDecodedSize is the most a compressed body can decode to, so that a small
+// message can't use up the memory
+const MaxDecodedSize = 64 << 20
+
+// zstd decoders are expensive to build but safe to share for DecodeAll
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxDecodedSize))
+
+// Apply copies the allowed headers into the payload. Headers with a single value
+// are copied as a string, others as a list.
+func (cfg *HeadersConfig) Apply(header nats.Header, p Payload) {
+	prefix := cfg.WithDefaults().Prefix
+
+	for name, values := range header {
+		if len(values) == 0 || !cfg.allowed(name) {
+			continue
+		}
+
+		if len(values) == 1 {
+			p[prefix+name] = values[0]
+		} else {
+			p[prefix+name] = values
+		}
+	}
+}
+
+// WithDefaults returns the config with the default prefix if it has none
+func (cfg HeadersConfig) WithDefaults() HeadersConfig {
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultHeaderPrefix
+	}
+	return cfg
+}
+
+func (cfg *HeadersConfig) allowed(name string) bool {
+	for _, deny := range cfg.Deny {
+		if strings.EqualFold(deny, name) {
+			return false
+		}
+	}
+
+	if len(cfg.Allow) == 0 {
+		return true
+	}
+	for _, allow := range cfg.Allow {
+		if strings.EqualFold(allow, name) {
+			return true
+		}
+	}
+	return false
+}
+
+var errTooLarge = fmt.Errorf("The body decodes to more than %d bytes", MaxDecodedSize)
+
+// DecodeBody undoes the Content-Encoding of the message (gzip, zstd or snappy).
+// It fails if the body would decode to more than MaxDecodedSize.
+func DecodeBody(data []byte, header nats.Header) ([]byte, error) {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get(contentEncodingHeader)))
+	switch encoding {
+	case "", "identity":
+		return data, nil
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		decoded, err := ioutil.ReadAll(io.LimitReader(r, MaxDecodedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(decoded) > MaxDecodedSize {
+			return nil, errTooLarge
+		}
+		return decoded, nil
+	case "zstd":
+		decoded, err := zstdDecoder.DecodeAll(data, nil)
+		if err == zstd.ErrDecoderSizeExceeded || err == zstd.ErrWindowSizeExceeded {
+			return nil, errTooLarge
+		}
+		return decoded, err
+	case "snappy":
+		size, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > MaxDecodedSize {
+			return nil, errTooLarge
+		}
+		return snappy.Decode(nil, data)
+	}
+
+	return nil, fmt.Errorf("Unsupported Content-Encoding '%s'", encoding)
+}
+
+// ShouldParseJSON is true unless the Content-Type says that the body isn't JSON.
+// Without a Content-Type every body is tried as JSON.
+func ShouldParseJSON(header nats.Header) bool {
+	contentType := strings.ToLower(header.Get(contentTypeHeader))
+	if contentType == "" {
+		return true
+	}
+
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+	return contentType == "application/json" || strings.HasSuffix(contentType, "+json")
+}
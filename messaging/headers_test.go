@@ -0,0 +1,118 @@
+package messaging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+const body = `{"msg": "hello"}`
+
+func TestApplyHeaders(t *testing.T) {
+	header := nats.Header{}
+	header.Set("Trace-Id", "abc")
+	header.Add("Tenant", "one")
+	header.Add("Tenant", "two")
+	header.Set("Authorization", "secret")
+
+	p := Payload{}
+	(&HeadersConfig{Deny: []string{"authorization"}}).Apply(header, p)
+
+	assert.Equal(t, Payload{
+		"@header.Trace-Id": "abc",
+		"@header.Tenant":   []string{"one", "two"},
+	}, p)
+}
+
+func TestApplyAllowedHeaders(t *testing.T) {
+	header := nats.Header{}
+	header.Set("Trace-Id", "abc")
+	header.Set("Tenant", "one")
+
+	p := Payload{}
+	(&HeadersConfig{Prefix: "h_", Allow: []string{"trace-id"}}).Apply(header, p)
+
+	assert.Equal(t, Payload{"h_Trace-Id": "abc"}, p)
+}
+
+func TestDecodeBody(t *testing.T) {
+	gzipped := new(bytes.Buffer)
+	w := gzip.NewWriter(gzipped)
+	w.Write([]byte(body))
+	w.Close()
+
+	encoder, _ := zstd.NewWriter(nil)
+	encoded := map[string][]byte{
+		"":       []byte(body),
+		"gzip":   gzipped.Bytes(),
+		"zstd":   encoder.EncodeAll([]byte(body), nil),
+		"snappy": snappy.Encode(nil, []byte(body)),
+	}
+
+	for encoding, data := range encoded {
+		header := nats.Header{}
+		if encoding != "" {
+			header.Set("Content-Encoding", encoding)
+		}
+
+		decoded, err := DecodeBody(data, header)
+		assert.Nil(t, err, encoding)
+		assert.Equal(t, body, string(decoded), encoding)
+	}
+}
+
+func TestDecodeBodyFailures(t *testing.T) {
+	header := nats.Header{}
+	header.Set("Content-Encoding", "br")
+	_, err := DecodeBody([]byte(body), header)
+	assert.EqualError(t, err, "Unsupported Content-Encoding 'br'")
+
+	header.Set("Content-Encoding", "gzip")
+	_, err = DecodeBody([]byte(body), header)
+	assert.NotNil(t, err)
+}
+
+func TestDecodeBodyLimit(t *testing.T) {
+	large := make([]byte, MaxDecodedSize+1)
+
+	gzipped := new(bytes.Buffer)
+	w := gzip.NewWriter(gzipped)
+	w.Write(large)
+	w.Close()
+
+	encoder, _ := zstd.NewWriter(nil)
+	encoded := map[string][]byte{
+		"gzip":   gzipped.Bytes(),
+		"zstd":   encoder.EncodeAll(large, nil),
+		"snappy": snappy.Encode(nil, large),
+	}
+
+	for encoding, data := range encoded {
+		header := nats.Header{}
+		header.Set("Content-Encoding", encoding)
+
+		_, err := DecodeBody(data, header)
+		assert.Equal(t, errTooLarge, err, encoding)
+	}
+}
+
+func TestShouldParseJSON(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"":                                true,
+		"application/json":                true,
+		"application/json; charset=utf-8": true,
+		"application/vnd.event+json":      true,
+		"text/plain":                      false,
+	} {
+		header := nats.Header{}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		assert.Equal(t, expected, ShouldParseJSON(header), contentType)
+	}
+}
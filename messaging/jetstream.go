@@ -0,0 +1,163 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultNakDelayMs = 5000
+
+	// pauseConsumerAPI is the JetStream API to pause a consumer, added in nats-server 2.11
+	pauseConsumerAPI = "$JS.API.CONSUMER.PAUSE.%s.%s"
+	pauseTimeout     = 5 * time.Second
+)
+
+// JetStreamConfig turns a subscription into a durable JetStream consumer. Each
+// message is acked once the bulk request that contained it succeeded, nak'd
+// with a delay if it failed in a way that might go away, and terminated if
+// it can't be indexed or has been delivered too often.
+type JetStreamConfig struct {
+	Stream  string `mapstructure:"stream"  json:"stream"  desc:"The stream to consume from"`
+	Durable string `mapstructure:"durable" json:"durable" desc:"The name of the durable consumer"`
+
+	// DeliverPolicy is where a new consumer starts: 'all' (the default), 'last', 'new' or 'last_per_subject'
+	DeliverPolicy string `mapstructure:"deliver_policy"  json:"deliver_policy"  desc:"Where a new consumer starts" default:"all" enum:"all,last,new,last_per_subject"`
+	MaxAckPending int    `mapstructure:"max_ack_pending" json:"max_ack_pending" desc:"The most messages that are waiting for an ack"`
+	AckWaitSec    int    `mapstructure:"ack_wait_sec"    json:"ack_wait_sec"    desc:"How long the server waits for an ack before redelivering, in seconds"`
+
+	// MaxDeliveries is how often a message is tried before it is terminated, 0 means forever
+	MaxDeliveries int `mapstructure:"max_deliveries" json:"max_deliveries" desc:"How often a message is tried before it is terminated, 0 means forever"`
+
+	// NakDelayMs is how long to wait before a failed message is redelivered, defaults to 5000
+	NakDelayMs int `mapstructure:"nak_delay_ms" json:"nak_delay_ms" desc:"How long to wait before a failed message is redelivered, in milliseconds" default:"5000"`
+}
+
+// The ways a message can be settled
+const (
+	Acked      = "ack"
+	Naked      = "nak"
+	Terminated = "term"
+)
+
+// Validate will check the required fields and the deliver policy
+func (cfg *JetStreamConfig) Validate() error {
+	if cfg.Stream == "" {
+		return errors.New("A JetStream consumer needs a stream")
+	}
+	if cfg.Durable == "" {
+		return errors.New("A JetStream consumer needs a durable name")
+	}
+	if _, err := cfg.deliverOption(); err != nil {
+		return err
+	}
+	if cfg.MaxAckPending < 0 || cfg.AckWaitSec < 0 || cfg.MaxDeliveries < 0 || cfg.NakDelayMs < 0 {
+		return errors.New("max_ack_pending, ack_wait_sec, max_deliveries and nak_delay_ms can't be negative")
+	}
+	return nil
+}
+
+// SubOptions builds the options for a durable, manually acked subscription
+func (cfg *JetStreamConfig) SubOptions() ([]nats.SubOpt, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	deliver, _ := cfg.deliverOption()
+	opts := []nats.SubOpt{
+		nats.BindStream(cfg.Stream),
+		nats.Durable(cfg.Durable),
+		nats.ManualAck(),
+		deliver,
+	}
+	if cfg.MaxAckPending > 0 {
+		opts = append(opts, nats.MaxAckPending(cfg.MaxAckPending))
+	}
+	if cfg.AckWaitSec > 0 {
+		opts = append(opts, nats.AckWait(time.Duration(cfg.AckWaitSec)*time.Second))
+	}
+	if cfg.MaxDeliveries > 0 {
+		opts = append(opts, nats.MaxDeliver(cfg.MaxDeliveries))
+	}
+
+	return opts, nil
+}
+
+// Settle will ack, nak or terminate the message depending on how indexing went.
+// It returns which one it did.
+func (cfg *JetStreamConfig) Settle(m *nats.Msg, res IndexResult) (string, error) {
+	if res.Err == nil {
+		return Acked, m.Ack()
+	}
+
+	if !res.Retryable {
+		return Terminated, m.Term()
+	}
+
+	if cfg.MaxDeliveries > 0 {
+		meta, err := m.Metadata()
+		if err == nil && meta.NumDelivered >= uint64(cfg.MaxDeliveries) {
+			return Terminated, m.Term()
+		}
+	}
+
+	delay := cfg.NakDelayMs
+	if delay == 0 {
+		delay = defaultNakDelayMs
+	}
+	return Naked, m.NakWithDelay(time.Duration(delay) * time.Millisecond)
+}
+
+func (cfg *JetStreamConfig) deliverOption() (nats.SubOpt, error) {
+	switch cfg.DeliverPolicy {
+	case "", "all":
+		return nats.DeliverAll(), nil
+	case "last":
+		return nats.DeliverLast(), nil
+	case "new":
+		return nats.DeliverNew(), nil
+	case "last_per_subject":
+		return nats.DeliverLastPerSubject(), nil
+	}
+	return nil, fmt.Errorf("Unknown deliver_policy '%s' - it must be one of all, last, new or last_per_subject", cfg.DeliverPolicy)
+}
+
+// Pause stops the server from delivering messages to the durable consumer until
+// the time, the zero time resumes it. The messages stay in the stream.
+func (cfg *JetStreamConfig) Pause(nc *nats.Conn, until time.Time) error {
+	action := "pause"
+	req := struct {
+		PauseUntil *time.Time `json:"pause_until,omitempty"`
+	}{}
+	if until.IsZero() {
+		action = "resume"
+	} else {
+		req.PauseUntil = &until
+	}
+
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	msg, err := nc.Request(fmt.Sprintf(pauseConsumerAPI, cfg.Stream, cfg.Durable), body, pauseTimeout)
+	if err != nil {
+		return fmt.Errorf("Failed to %s the consumer %s: %v", action, cfg.Durable, err)
+	}
+
+	resp := struct {
+		Error *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}{}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return fmt.Errorf("Failed to parse the response to %s the consumer %s: %v", action, cfg.Durable, err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("Failed to %s the consumer %s: %s", action, cfg.Durable, resp.Error.Description)
+	}
+	return nil
+}
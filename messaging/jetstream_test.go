@@ -0,0 +1,50 @@
+package messaging
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJetStreamValidation(t *testing.T) {
+	assert.EqualError(t, (&JetStreamConfig{Durable: "elastinats"}).Validate(), "A JetStream consumer needs a stream")
+	assert.EqualError(t, (&JetStreamConfig{Stream: "LOGS"}).Validate(), "A JetStream consumer needs a durable name")
+	assert.EqualError(t, (&JetStreamConfig{Stream: "LOGS", Durable: "elastinats", DeliverPolicy: "first"}).Validate(),
+		"Unknown deliver_policy 'first' - it must be one of all, last, new or last_per_subject")
+	assert.NotNil(t, (&JetStreamConfig{Stream: "LOGS", Durable: "elastinats", MaxDeliveries: -1}).Validate())
+}
+
+func TestJetStreamSubOptions(t *testing.T) {
+	opts, err := (&JetStreamConfig{Stream: "LOGS", Durable: "elastinats"}).SubOptions()
+	assert.Nil(t, err)
+	assert.Len(t, opts, 4)
+
+	opts, err = (&JetStreamConfig{
+		Stream:        "LOGS",
+		Durable:       "elastinats",
+		DeliverPolicy: "new",
+		MaxAckPending: 1000,
+		AckWaitSec:    30,
+		MaxDeliveries: 5,
+	}).SubOptions()
+	assert.Nil(t, err)
+	assert.Len(t, opts, 7)
+}
+
+func TestSettleAction(t *testing.T) {
+	cfg := &JetStreamConfig{Stream: "LOGS", Durable: "elastinats"}
+
+	// the message isn't bound to a subscription so settling it fails, but it
+	// still tells us what it tried to do
+	action, err := cfg.Settle(&nats.Msg{}, IndexResult{})
+	assert.Equal(t, Acked, action)
+	assert.NotNil(t, err)
+
+	action, _ = cfg.Settle(&nats.Msg{}, IndexResult{Err: errors.New("mapper_parsing_exception")})
+	assert.Equal(t, Terminated, action)
+
+	action, _ = cfg.Settle(&nats.Msg{}, IndexResult{Err: errors.New("rejected"), Retryable: true})
+	assert.Equal(t, Naked, action)
+}
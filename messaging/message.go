@@ -0,0 +1,64 @@
+package messaging
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Message is a payload on its way to elasticsearch. Done is called with the
+// result for the document once the bulk request that contained it is finished.
+type Message struct {
+	Payload  Payload
+	Received time.Time
+	Done     func(IndexResult)
+}
+
+// IndexResult is the outcome of indexing a single document
+type IndexResult struct {
+	ID    string
+	Index string
+	Err   error
+
+	// Retryable is true if the failure might go away when the document is sent again
+	Retryable bool
+}
+
+// NewMessage wraps the payload, done can be nil
+func NewMessage(p Payload, done func(IndexResult)) Message {
+	return Message{
+		Payload:  p,
+		Received: time.Now(),
+		Done:     done,
+	}
+}
+
+// Finish calls Done if there is one
+func (m Message) Finish(res IndexResult) {
+	if m.Done != nil {
+		m.Done(res)
+	}
+}
+
+// IndexReply is what producers that asked for an acknowledgement get back
+type IndexReply struct {
+	ID      string `json:"id,omitempty"`
+	Index   string `json:"index,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Reply builds the JSON acknowledgement for the result
+func (res IndexResult) Reply() []byte {
+	reply := IndexReply{
+		ID:      res.ID,
+		Index:   res.Index,
+		Success: res.Err == nil,
+	}
+	if res.Err != nil {
+		reply.Error = res.Err.Error()
+	}
+
+	// it is only strings and a bool, this can't fail
+	bs, _ := json.Marshal(&reply)
+	return bs
+}
@@ -0,0 +1,16 @@
+package messaging
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReply(t *testing.T) {
+	assert.JSONEq(t, `{"id": "abc", "index": "logs", "success": true}`,
+		string(IndexResult{ID: "abc", Index: "logs"}.Reply()))
+
+	assert.JSONEq(t, `{"index": "logs", "success": false, "error": "rejected"}`,
+		string(IndexResult{Index: "logs", Err: errors.New("rejected"), Retryable: true}.Reply()))
+}
@@ -0,0 +1,201 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxLines       = 500
+	defaultFlushTimeoutMs = 1000
+)
+
+// MultilineConfig describes how messages that are continuations of a previous
+// message (e.g. the lines of a stack trace) are joined into one event.
+type MultilineConfig struct {
+	// Pattern is matched against the raw message, if it matches the message
+	// is appended to the previous one. e.g. '^(\s+at |Caused by:|\s+\.\.\. )'
+	Pattern string `mapstructure:"pattern"          json:"pattern"          desc:"Messages that match the pattern are appended to the previous one"`
+
+	// KeyField is the payload field that events are grouped by, defaults to '@source'
+	KeyField string `mapstructure:"key_field"        json:"key_field"        desc:"The payload field that events are grouped by" default:"@source"`
+
+	// MaxLines is the most lines that are joined before the event is sent on
+	MaxLines int `mapstructure:"max_lines"        json:"max_lines"        desc:"The most lines that are joined into one event" default:"500"`
+
+	// FlushTimeoutMs is how long an event waits for more lines before it is sent on
+	FlushTimeoutMs int `mapstructure:"flush_timeout_ms" json:"flush_timeout_ms" desc:"How long an event waits for more lines in milliseconds" default:"1000"`
+}
+
+// Multiline joins continuation lines onto the previous event with the same key
+// and sends the joined events on when they are complete.
+type Multiline struct {
+	pattern  *regexp.Regexp
+	keyField string
+	maxLines int
+	timeout  time.Duration
+
+	out      chan<- Message
+	shutdown chan bool
+
+	mu      sync.Mutex
+	pending map[string]*multilineEvent
+}
+
+type multilineEvent struct {
+	first   Message
+	lines   []string
+	dones   []func(IndexResult)
+	updated time.Time
+}
+
+// Validate checks that there is a pattern and that it compiles
+func (config *MultilineConfig) Validate() error {
+	_, err := config.compile()
+	return err
+}
+
+func (config *MultilineConfig) compile() (*regexp.Regexp, error) {
+	if config.Pattern == "" {
+		return nil, errors.New("A multiline pattern is required")
+	}
+	pattern, err := regexp.Compile(config.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to compile multiline pattern '%s': %v", config.Pattern, err)
+	}
+	return pattern, nil
+}
+
+// WithDefaults returns the config with the defaults for everything that isn't set
+func (config MultilineConfig) WithDefaults() MultilineConfig {
+	if config.KeyField == "" {
+		config.KeyField = sourceKey
+	}
+	if config.MaxLines <= 0 {
+		config.MaxLines = defaultMaxLines
+	}
+	if config.FlushTimeoutMs <= 0 {
+		config.FlushTimeoutMs = defaultFlushTimeoutMs
+	}
+	return config
+}
+
+// NewMultiline will build the aggregator and start flushing events that have
+// timed out
+func NewMultiline(config *MultilineConfig, out chan<- Message) (*Multiline, error) {
+	pattern, err := config.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := config.WithDefaults()
+	m := &Multiline{
+		pattern:  pattern,
+		keyField: resolved.KeyField,
+		maxLines: resolved.MaxLines,
+		timeout:  time.Duration(resolved.FlushTimeoutMs) * time.Millisecond,
+		out:      out,
+		shutdown: make(chan bool),
+		pending:  make(map[string]*multilineEvent),
+	}
+
+	go m.flushForever()
+
+	return m, nil
+}
+
+// Add will either start a new event or append the message to the pending one
+func (m *Multiline) Add(msg Message) {
+	key := fmt.Sprint(msg.Payload[m.keyField])
+	line, _ := msg.Payload[rawMsgKey].(string)
+
+	ready := []Message{}
+	m.mu.Lock()
+	current, exists := m.pending[key]
+	if exists && m.pattern.MatchString(line) {
+		current.lines = append(current.lines, line)
+		current.dones = append(current.dones, msg.Done)
+		current.updated = time.Now()
+		if len(current.lines) >= m.maxLines {
+			ready = append(ready, current.join())
+			delete(m.pending, key)
+		}
+	} else {
+		if exists {
+			ready = append(ready, current.join())
+		}
+		m.pending[key] = &multilineEvent{
+			first:   msg,
+			lines:   []string{line},
+			dones:   []func(IndexResult){msg.Done},
+			updated: time.Now(),
+		}
+	}
+	m.mu.Unlock()
+
+	m.send(ready)
+}
+
+// Close will stop the flushing and send on all the pending events
+func (m *Multiline) Close() {
+	close(m.shutdown)
+	m.flush(func(*multilineEvent) bool { return true })
+}
+
+func (m *Multiline) flushForever() {
+	ticks := time.NewTicker(m.timeout / 2)
+	defer ticks.Stop()
+	for {
+		select {
+		case <-ticks.C:
+			cutoff := time.Now().Add(-m.timeout)
+			m.flush(func(e *multilineEvent) bool { return e.updated.Before(cutoff) })
+		case <-m.shutdown:
+			return
+		}
+	}
+}
+
+func (m *Multiline) flush(shouldFlush func(*multilineEvent) bool) {
+	ready := []Message{}
+	m.mu.Lock()
+	for key, e := range m.pending {
+		if shouldFlush(e) {
+			ready = append(ready, e.join())
+			delete(m.pending, key)
+		}
+	}
+	m.mu.Unlock()
+
+	m.send(ready)
+}
+
+func (m *Multiline) send(ready []Message) {
+	for _, msg := range ready {
+		m.out <- msg
+	}
+}
+
+// join builds the event from the first message, and makes sure that all the
+// messages that went into it are told how indexing went
+func (e *multilineEvent) join() Message {
+	if len(e.lines) == 1 {
+		return e.first
+	}
+
+	joined := e.first
+	joined.Payload[rawMsgKey] = strings.Join(e.lines, "\n")
+	dones := e.dones
+	joined.Done = func(res IndexResult) {
+		for _, done := range dones {
+			if done != nil {
+				done(res)
+			}
+		}
+	}
+	return joined
+}
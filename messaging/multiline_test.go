@@ -0,0 +1,108 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var stackTrace = []string{
+	"Exception in thread \"main\" java.lang.NullPointerException",
+	"\tat com.example.Main.run(Main.java:14)",
+	"\tat com.example.Main.main(Main.java:5)",
+}
+
+func TestMultilineJoinsContinuations(t *testing.T) {
+	out := make(chan Message, 10)
+	m, err := NewMultiline(&MultilineConfig{Pattern: `^\s+at `}, out)
+	assert.Nil(t, err)
+
+	for _, line := range stackTrace {
+		m.Add(msg(line, "logs.java"))
+	}
+	m.Add(msg("next event", "logs.java"))
+
+	first := <-out
+	assert.Equal(t, "Exception in thread \"main\" java.lang.NullPointerException\n"+
+		"\tat com.example.Main.run(Main.java:14)\n"+
+		"\tat com.example.Main.main(Main.java:5)", first.Payload[rawMsgKey])
+
+	m.Close()
+	assert.Equal(t, "next event", (<-out).Payload[rawMsgKey])
+}
+
+func TestMultilineKeepsSourcesApart(t *testing.T) {
+	out := make(chan Message, 10)
+	m, err := NewMultiline(&MultilineConfig{Pattern: `^\s+at `}, out)
+	assert.Nil(t, err)
+
+	m.Add(msg(stackTrace[0], "logs.one"))
+	m.Add(msg("first of two", "logs.two"))
+	m.Add(msg(stackTrace[1], "logs.one"))
+	m.Close()
+
+	got := map[interface{}]interface{}{}
+	for i := 0; i < 2; i++ {
+		p := (<-out).Payload
+		got[p[sourceKey]] = p[rawMsgKey]
+	}
+	assert.Equal(t, stackTrace[0]+"\n"+stackTrace[1], got["logs.one"])
+	assert.Equal(t, "first of two", got["logs.two"])
+}
+
+func TestMultilineMaxLines(t *testing.T) {
+	out := make(chan Message, 10)
+	m, err := NewMultiline(&MultilineConfig{Pattern: `^\s+at `, MaxLines: 2}, out)
+	assert.Nil(t, err)
+	defer m.Close()
+
+	for _, line := range stackTrace {
+		m.Add(msg(line, "logs.java"))
+	}
+
+	assert.Equal(t, stackTrace[0]+"\n"+stackTrace[1], (<-out).Payload[rawMsgKey])
+}
+
+func TestMultilineFlushTimeout(t *testing.T) {
+	out := make(chan Message, 10)
+	m, err := NewMultiline(&MultilineConfig{Pattern: `^\s+at `, FlushTimeoutMs: 20}, out)
+	assert.Nil(t, err)
+	defer m.Close()
+
+	m.Add(msg(stackTrace[0], "logs.java"))
+
+	select {
+	case got := <-out:
+		assert.Equal(t, stackTrace[0], got.Payload[rawMsgKey])
+	case <-time.After(time.Second):
+		assert.FailNow(t, "timed out waiting for the flush")
+	}
+}
+
+func TestMultilineBadPattern(t *testing.T) {
+	_, err := NewMultiline(&MultilineConfig{Pattern: `(`}, make(chan Message))
+	assert.NotNil(t, err)
+
+	_, err = NewMultiline(&MultilineConfig{}, make(chan Message))
+	assert.NotNil(t, err)
+}
+
+func TestMultilineFinishesAllMessages(t *testing.T) {
+	out := make(chan Message, 10)
+	m, err := NewMultiline(&MultilineConfig{Pattern: `^\s+at `}, out)
+	assert.Nil(t, err)
+
+	finished := 0
+	for _, line := range stackTrace {
+		m.Add(NewMessage(*NewPayload(line, "logs.java"), func(IndexResult) { finished++ }))
+	}
+	m.Close()
+
+	(<-out).Finish(IndexResult{})
+	assert.Equal(t, len(stackTrace), finished)
+}
+
+func msg(raw, source string) Message {
+	return NewMessage(*NewPayload(raw, source), nil)
+}
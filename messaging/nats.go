@@ -3,43 +3,149 @@ package messaging
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"time"
 
-	"github.com/nats-io/nats"
+	"github.com/nats-io/nats.go"
 )
 
 type NatsConfig struct {
-	CAFiles  []string `mapstructure:"ca_files"  json:"ca_files"`
-	KeyFile  string   `mapstructure:"key_file"  json:"key_file"`
-	CertFile string   `mapstructure:"cert_file" json:"cert_file"`
-	Servers  []string `mapstructure:"servers"   json:"servers"`
+	// TLS is used if any of these are set. The cert and key are only needed if
+	// the server requires a client certificate. If only TLS is set the system
+	// roots are used to verify the server.
+	TLS      bool     `mapstructure:"tls"       json:"tls"       desc:"Connect with TLS, using the system roots if no ca_files are set"`
+	CAFiles  []string `mapstructure:"ca_files"  json:"ca_files"  desc:"The CA certificates that the server certificate is verified with"`
+	KeyFile  string   `mapstructure:"key_file"  json:"key_file"  desc:"The key of the client certificate"`
+	CertFile string   `mapstructure:"cert_file" json:"cert_file" desc:"The client certificate, if the server requires one"`
+	Servers  []string `mapstructure:"servers"   json:"servers"   desc:"The nats servers to connect to"`
+
+	// Only one of these ways to authenticate can be used
+	User      string `mapstructure:"user"       json:"user"       desc:"The user to authenticate with"`
+	Password  string `mapstructure:"password"   json:"password"   secret:"true" desc:"The password of the user"`
+	Token     string `mapstructure:"token"      json:"token"      secret:"true" desc:"A token to authenticate with"`
+	NKeyFile  string `mapstructure:"nkey_file"  json:"nkey_file"  desc:"An nkey seed file to authenticate with"`
+	CredsFile string `mapstructure:"creds_file" json:"creds_file" desc:"A credentials file with a user JWT and nkey seed"`
+
+	// MaxReconnects is how often to try to reconnect before the connection is
+	// closed for good, -1 (or 0) keeps trying forever. The other reconnect
+	// settings use the library defaults if they're 0.
+	MaxReconnects     int `mapstructure:"max_reconnects"      json:"max_reconnects"      desc:"How often to try to reconnect before giving up, -1 keeps trying forever" default:"-1"`
+	ReconnectWaitMs   int `mapstructure:"reconnect_wait_ms"   json:"reconnect_wait_ms"   desc:"How long to wait between reconnects in milliseconds"`
+	ReconnectJitterMs int `mapstructure:"reconnect_jitter_ms" json:"reconnect_jitter_ms" desc:"The most random time added to the reconnect wait in milliseconds"`
+	ReconnectBufSize  int `mapstructure:"reconnect_buf_size"  json:"reconnect_buf_size"  desc:"How many bytes are buffered while reconnecting"`
+
+	// ClosedPolicy is what happens when the connection is closed for good: 'wait'
+	// (the default) keeps the process running and 'exit' stops it.
+	ClosedPolicy string `mapstructure:"closed_policy" json:"closed_policy" desc:"What happens when the connection is closed for good" default:"wait" enum:"wait,exit"`
 }
 
-// TLSConfig will load the TLS certificate
-func (cfg *NatsConfig) TLSConfig() (*tls.Config, error) {
-	pool := x509.NewCertPool()
-	for _, caFile := range cfg.CAFiles {
-		caData, err := ioutil.ReadFile(caFile)
-		if err != nil {
-			return nil, err
-		}
+const (
+	ClosedPolicyExit = "exit"
+	ClosedPolicyWait = "wait"
+)
 
-		if !pool.AppendCertsFromPEM(caData) {
-			return nil, fmt.Errorf("Failed to add CA cert at %s", caFile)
-		}
+// ExitOnClose is true if the process should stop once the connection is closed
+func (cfg *NatsConfig) ExitOnClose() bool {
+	return cfg.ClosedPolicy == ClosedPolicyExit
+}
+
+// UsesTLS is true if any of the TLS settings are set
+func (cfg *NatsConfig) UsesTLS() bool {
+	return cfg.TLS || len(cfg.CAFiles) > 0 || cfg.CertFile != "" || cfg.KeyFile != ""
+}
+
+// AuthMethod is the name of the configured way to authenticate
+func (cfg *NatsConfig) AuthMethod() string {
+	methods := cfg.authMethods()
+	if len(methods) == 0 {
+		return "none"
 	}
+	return strings.Join(methods, ",")
+}
 
-	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
-	if err != nil {
-		return nil, err
+func (cfg *NatsConfig) authMethods() []string {
+	methods := []string{}
+	if cfg.User != "" || cfg.Password != "" {
+		methods = append(methods, "user/password")
+	}
+	if cfg.Token != "" {
+		methods = append(methods, "token")
+	}
+	if cfg.NKeyFile != "" {
+		methods = append(methods, "nkey_file")
+	}
+	if cfg.CredsFile != "" {
+		methods = append(methods, "creds_file")
+	}
+	return methods
+}
+
+// Validate will check that the TLS, auth and reconnect settings make sense together
+func (cfg *NatsConfig) Validate() error {
+	if cfg.CertFile != "" && cfg.KeyFile == "" {
+		return errors.New("cert_file is set without a key_file - both are needed for a client certificate")
+	}
+	if cfg.KeyFile != "" && cfg.CertFile == "" {
+		return errors.New("key_file is set without a cert_file - both are needed for a client certificate")
+	}
+
+	if cfg.User != "" && cfg.Password == "" {
+		return errors.New("user is set without a password")
+	}
+	if cfg.Password != "" && cfg.User == "" {
+		return errors.New("password is set without a user")
+	}
+
+	if methods := cfg.authMethods(); len(methods) > 1 {
+		return fmt.Errorf("Only one of user/password, token, nkey_file and creds_file can be used but found: %s", strings.Join(methods, ", "))
+	}
+
+	if cfg.MaxReconnects < -1 {
+		return fmt.Errorf("max_reconnects must be -1 (forever) or more, not %d", cfg.MaxReconnects)
+	}
+	if cfg.ReconnectWaitMs < 0 || cfg.ReconnectJitterMs < 0 {
+		return errors.New("reconnect_wait_ms and reconnect_jitter_ms can't be negative")
+	}
+
+	switch cfg.ClosedPolicy {
+	case "", ClosedPolicyExit, ClosedPolicyWait:
+	default:
+		return fmt.Errorf("Unknown closed_policy '%s' - it must be '%s' or '%s'", cfg.ClosedPolicy, ClosedPolicyExit, ClosedPolicyWait)
 	}
 
+	return nil
+}
+
+// TLSConfig will load the CAs and the client certificate if there is one
+func (cfg *NatsConfig) TLSConfig() (*tls.Config, error) {
 	tlsConfig := &tls.Config{
-		RootCAs:      pool,
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(cfg.CAFiles) > 0 {
+		pool := x509.NewCertPool()
+		for _, caFile := range cfg.CAFiles {
+			caData, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+
+			if !pool.AppendCertsFromPEM(caData) {
+				return nil, fmt.Errorf("Failed to add CA cert at %s", caFile)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
 	return tlsConfig, nil
@@ -50,16 +156,70 @@ func (config *NatsConfig) ServerString() string {
 	return strings.Join(config.Servers, ",")
 }
 
-// ConnectToNats will do a TLS connection to the nats servers specified
-func ConnectToNats(config *NatsConfig, errHandler nats.ErrHandler) (*nats.Conn, error) {
-	tlsConfig, err := config.TLSConfig()
+// Options will build the TLS, auth and reconnect options for connecting
+func (config *NatsConfig) Options() ([]nats.Option, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	opts := []nats.Option{}
+	if config.UsesTLS() {
+		tlsConfig, err := config.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+
+	switch {
+	case config.User != "":
+		opts = append(opts, nats.UserInfo(config.User, config.Password))
+	case config.Token != "":
+		opts = append(opts, nats.Token(config.Token))
+	case config.NKeyFile != "":
+		opt, err := nats.NkeyOptionFromSeed(config.NKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	case config.CredsFile != "":
+		opts = append(opts, nats.UserCredentials(config.CredsFile))
+	}
+
+	// it keeps trying unless a limit is set, so that an outage doesn't leave a
+	// process behind that doesn't consume anymore
+	maxReconnects := config.MaxReconnects
+	if maxReconnects == 0 {
+		maxReconnects = -1
+	}
+	opts = append(opts, nats.MaxReconnects(maxReconnects))
+	if config.ReconnectWaitMs > 0 {
+		opts = append(opts, nats.ReconnectWait(time.Duration(config.ReconnectWaitMs)*time.Millisecond))
+	}
+	if config.ReconnectJitterMs > 0 {
+		jitter := time.Duration(config.ReconnectJitterMs) * time.Millisecond
+		opts = append(opts, nats.ReconnectJitter(jitter, jitter))
+	}
+	if config.ReconnectBufSize != 0 {
+		opts = append(opts, nats.ReconnectBufSize(config.ReconnectBufSize))
+	}
+
+	return opts, nil
+}
+
+// ConnectToNats will connect to the nats servers specified, using TLS and auth if
+// configured. Any extra options, like the handlers for connection events, are
+// applied after the ones from the config.
+func ConnectToNats(config *NatsConfig, errHandler nats.ErrHandler, extra ...nats.Option) (*nats.Conn, error) {
+	opts, err := config.Options()
 	if err != nil {
 		return nil, err
 	}
 
 	if errHandler != nil {
-		return nats.Connect(config.ServerString(), nats.Secure(tlsConfig), nats.ErrorHandler(errHandler))
+		opts = append(opts, nats.ErrorHandler(errHandler))
 	}
+	opts = append(opts, extra...)
 
-	return nats.Connect(config.ServerString(), nats.Secure(tlsConfig))
+	return nats.Connect(config.ServerString(), opts...)
 }
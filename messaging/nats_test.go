@@ -0,0 +1,100 @@
+package messaging
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func applied(t *testing.T, opts []nats.Option) nats.Options {
+	o := nats.GetDefaultOptions()
+	for _, opt := range opts {
+		assert.Nil(t, opt(&o))
+	}
+	return o
+}
+
+func TestPlaintextWithoutAuth(t *testing.T) {
+	cfg := &NatsConfig{Servers: []string{"nats://localhost:4222"}}
+
+	assert.Nil(t, cfg.Validate())
+	assert.False(t, cfg.UsesTLS())
+	assert.Equal(t, "none", cfg.AuthMethod())
+
+	// only that it keeps reconnecting
+	opts, err := cfg.Options()
+	assert.Nil(t, err)
+	assert.Len(t, opts, 1)
+	assert.Equal(t, -1, applied(t, opts).MaxReconnect)
+}
+
+func TestServerOnlyTLS(t *testing.T) {
+	cfg := &NatsConfig{TLS: true}
+
+	assert.Nil(t, cfg.Validate())
+	assert.True(t, cfg.UsesTLS())
+
+	tlsConfig, err := cfg.TLSConfig()
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig.RootCAs)
+	assert.Empty(t, tlsConfig.Certificates)
+}
+
+func TestClientCertNeedsBothFiles(t *testing.T) {
+	err := (&NatsConfig{CertFile: "cert.pem"}).Validate()
+	assert.EqualError(t, err, "cert_file is set without a key_file - both are needed for a client certificate")
+
+	err = (&NatsConfig{KeyFile: "key.pem"}).Validate()
+	assert.EqualError(t, err, "key_file is set without a cert_file - both are needed for a client certificate")
+}
+
+func TestUserNeedsPassword(t *testing.T) {
+	assert.EqualError(t, (&NatsConfig{User: "elastinats"}).Validate(), "user is set without a password")
+	assert.EqualError(t, (&NatsConfig{Password: "secret"}).Validate(), "password is set without a user")
+	assert.Nil(t, (&NatsConfig{User: "elastinats", Password: "secret"}).Validate())
+}
+
+func TestOnlyOneAuthMethod(t *testing.T) {
+	cfg := &NatsConfig{Token: "secret", CredsFile: "elastinats.creds"}
+
+	assert.EqualError(t, cfg.Validate(), "Only one of user/password, token, nkey_file and creds_file can be used but found: token, creds_file")
+	_, err := cfg.Options()
+	assert.NotNil(t, err)
+}
+
+func TestAuthOptions(t *testing.T) {
+	opts, err := (&NatsConfig{Token: "secret"}).Options()
+	assert.Nil(t, err)
+	assert.Len(t, opts, 2)
+
+	opts, err = (&NatsConfig{CredsFile: "elastinats.creds", TLS: true}).Options()
+	assert.Nil(t, err)
+	assert.Len(t, opts, 3)
+
+	_, err = (&NatsConfig{NKeyFile: "/does/not/exist.nk"}).Options()
+	assert.NotNil(t, err)
+}
+
+func TestReconnectSettings(t *testing.T) {
+	cfg := &NatsConfig{MaxReconnects: -1, ReconnectWaitMs: 500, ReconnectJitterMs: 100, ReconnectBufSize: 1024}
+	opts, err := cfg.Options()
+	assert.Nil(t, err)
+	assert.Len(t, opts, 4)
+	assert.Equal(t, -1, applied(t, opts).MaxReconnect)
+
+	opts, err = (&NatsConfig{MaxReconnects: 5}).Options()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, applied(t, opts).MaxReconnect)
+
+	assert.NotNil(t, (&NatsConfig{MaxReconnects: -2}).Validate())
+	assert.NotNil(t, (&NatsConfig{ReconnectWaitMs: -1}).Validate())
+}
+
+func TestClosedPolicy(t *testing.T) {
+	assert.False(t, (&NatsConfig{}).ExitOnClose())
+	assert.True(t, (&NatsConfig{ClosedPolicy: ClosedPolicyExit}).ExitOnClose())
+	assert.False(t, (&NatsConfig{ClosedPolicy: ClosedPolicyWait}).ExitOnClose())
+
+	assert.EqualError(t, (&NatsConfig{ClosedPolicy: "retry"}).Validate(), "Unknown closed_policy 'retry' - it must be 'exit' or 'wait'")
+}
@@ -1,6 +1,11 @@
 package messaging
 
-import "time"
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
 
 const (
 	rawMsgKey    = "@raw_msg"
@@ -10,6 +15,29 @@ const (
 
 type Payload map[string]interface{}
 
+// PayloadConfig controls how a parsed payload is reshaped before it is sent
+// to elasticsearch. This is useful to keep deeply nested or dynamic JSON from
+// blowing through the field limits of the index mapping.
+type PayloadConfig struct {
+	// Flatten turns nested objects into dotted keys: {"a": {"b": 1}} -> {"a.b": 1}
+	Flatten bool `mapstructure:"flatten"   json:"flatten"   desc:"Turn nested objects into dotted keys"`
+
+	// MaxDepth is the number of object levels that are kept as is, anything
+	// nested deeper is serialized to a JSON string. 0 means no limit.
+	MaxDepth int `mapstructure:"max_depth" json:"max_depth" desc:"The object levels that are kept as is, deeper ones are serialized to a string. 0 means no limit"`
+
+	// MaxKeys caps the number of top level keys in a document (after flattening).
+	// The special '@' keys are always kept. 0 means no limit.
+	MaxKeys int `mapstructure:"max_keys"  json:"max_keys"  desc:"The most top level keys in a document, 0 means no limit"`
+}
+
+// Limits reports which of the PayloadConfig limits were hit while shaping a payload
+type Limits struct {
+	Flattened    bool
+	DepthLimited bool
+	KeyLimited   bool
+}
+
 func NewPayload(msg, source string) *Payload {
 	return &Payload{
 		rawMsgKey:    msg,
@@ -17,3 +45,104 @@ func NewPayload(msg, source string) *Payload {
 		timestampKey: time.Now().Format(time.RFC3339),
 	}
 }
+
+// Shape will apply the depth limit, flattening and key limit in that order.
+// The payload is modified in place.
+func (p Payload) Shape(config *PayloadConfig) Limits {
+	limits := Limits{}
+	if config == nil {
+		return limits
+	}
+
+	if config.MaxDepth > 0 {
+		for k, v := range p {
+			var hit bool
+			p[k], hit = limitDepth(v, 1, config.MaxDepth)
+			limits.DepthLimited = limits.DepthLimited || hit
+		}
+	}
+
+	if config.Flatten {
+		for k, v := range p {
+			if nested, ok := v.(map[string]interface{}); ok {
+				delete(p, k)
+				flatten(p, k+".", nested)
+				limits.Flattened = true
+			}
+		}
+	}
+
+	if config.MaxKeys > 0 && len(p) > config.MaxKeys {
+		limits.KeyLimited = true
+		limitKeys(p, config.MaxKeys)
+	}
+
+	return limits
+}
+
+func limitDepth(v interface{}, depth, max int) (interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if depth >= max {
+			return stringify(t), true
+		}
+
+		hit := false
+		for k, child := range t {
+			var childHit bool
+			t[k], childHit = limitDepth(child, depth+1, max)
+			hit = hit || childHit
+		}
+		return t, hit
+	case []interface{}:
+		hit := false
+		for i, child := range t {
+			var childHit bool
+			t[i], childHit = limitDepth(child, depth, max)
+			hit = hit || childHit
+		}
+		return t, hit
+	}
+
+	return v, false
+}
+
+func flatten(into Payload, prefix string, nested map[string]interface{}) {
+	for k, v := range nested {
+		if child, ok := v.(map[string]interface{}); ok {
+			flatten(into, prefix+k+".", child)
+		} else {
+			into[prefix+k] = v
+		}
+	}
+}
+
+// limitKeys drops keys until there are only max left. It keeps the special keys
+// and then the rest in sorted order so that it is stable between messages.
+func limitKeys(p Payload, max int) {
+	keys := make([]string, 0, len(p))
+	for k := range p {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		iSpecial, jSpecial := strings.HasPrefix(keys[i], "@"), strings.HasPrefix(keys[j], "@")
+		if iSpecial != jSpecial {
+			return iSpecial
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, k := range keys[max:] {
+		if !strings.HasPrefix(k, "@") {
+			delete(p, k)
+		}
+	}
+}
+
+func stringify(v interface{}) string {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(bs)
+}
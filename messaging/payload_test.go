@@ -0,0 +1,90 @@
+package messaging
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const nested = `{
+	"level": "info",
+	"request": {
+		"method": "GET",
+		"headers": {
+			"host": "netlify.com",
+			"accept": {"type": "json"}
+		}
+	}
+}`
+
+func TestShapeWithoutConfig(t *testing.T) {
+	p := parse(t, nested)
+	limits := p.Shape(nil)
+
+	assert.Equal(t, Limits{}, limits)
+	assert.Equal(t, parse(t, nested), p)
+}
+
+func TestFlatten(t *testing.T) {
+	p := parse(t, nested)
+	limits := p.Shape(&PayloadConfig{Flatten: true})
+
+	assert.Equal(t, Limits{Flattened: true}, limits)
+	assert.Equal(t, Payload{
+		"level":                       "info",
+		"request.method":              "GET",
+		"request.headers.host":        "netlify.com",
+		"request.headers.accept.type": "json",
+	}, p)
+}
+
+func TestMaxDepth(t *testing.T) {
+	p := parse(t, nested)
+	limits := p.Shape(&PayloadConfig{MaxDepth: 2})
+
+	assert.Equal(t, Limits{DepthLimited: true}, limits)
+	req := p["request"].(map[string]interface{})
+	assert.Equal(t, "GET", req["method"])
+	assert.JSONEq(t, `{"host": "netlify.com", "accept": {"type": "json"}}`, req["headers"].(string))
+}
+
+func TestMaxDepthNotHit(t *testing.T) {
+	p := parse(t, nested)
+	limits := p.Shape(&PayloadConfig{MaxDepth: 4})
+
+	assert.Equal(t, Limits{}, limits)
+	assert.Equal(t, parse(t, nested), p)
+}
+
+func TestMaxDepthThenFlatten(t *testing.T) {
+	p := parse(t, nested)
+	limits := p.Shape(&PayloadConfig{MaxDepth: 2, Flatten: true})
+
+	assert.Equal(t, Limits{DepthLimited: true, Flattened: true}, limits)
+	assert.Len(t, p, 3)
+	assert.Equal(t, "GET", p["request.method"])
+	assert.IsType(t, "", p["request.headers"])
+}
+
+func TestMaxKeys(t *testing.T) {
+	p := *NewPayload("raw", "logs.test")
+	p["c"] = 3
+	p["a"] = 1
+	p["b"] = 2
+
+	limits := p.Shape(&PayloadConfig{MaxKeys: 4})
+
+	assert.Equal(t, Limits{KeyLimited: true}, limits)
+	assert.Len(t, p, 4)
+	assert.Equal(t, "raw", p[rawMsgKey])
+	assert.Equal(t, "logs.test", p[sourceKey])
+	assert.Contains(t, p, timestampKey)
+	assert.Equal(t, 1, p["a"])
+}
+
+func parse(t *testing.T, raw string) Payload {
+	p := Payload{}
+	assert.Nil(t, json.Unmarshal([]byte(raw), &p))
+	return p
+}
@@ -0,0 +1,78 @@
+package messaging
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SubjectMapping extracts named tokens from a subject into payload fields. The
+// pattern is a subject where a token can be a literal that has to match, a
+// '{name}' that is copied into the field 'name', a '*' that matches anything or
+// a trailing '>' that matches the rest of the subject.
+//
+//	logs.{env}.{service}.*  applied to  logs.prod.api.host1  gives  env=prod service=api
+type SubjectMapping struct {
+	pattern string
+	tokens  []string
+}
+
+// NewSubjectMapping will validate the pattern and build the mapping
+func NewSubjectMapping(pattern string) (*SubjectMapping, error) {
+	tokens := strings.Split(pattern, ".")
+	for i, t := range tokens {
+		switch {
+		case t == "":
+			return nil, fmt.Errorf("Empty token at position %d in subject mapping '%s'", i, pattern)
+		case t == ">" && i != len(tokens)-1:
+			return nil, fmt.Errorf("'>' must be the last token in subject mapping '%s'", pattern)
+		case strings.HasPrefix(t, "{") != strings.HasSuffix(t, "}"):
+			return nil, fmt.Errorf("Unbalanced braces in token '%s' of subject mapping '%s'", t, pattern)
+		case t == "{}":
+			return nil, fmt.Errorf("Missing field name at position %d in subject mapping '%s'", i, pattern)
+		}
+	}
+
+	return &SubjectMapping{
+		pattern: pattern,
+		tokens:  tokens,
+	}, nil
+}
+
+// Extract returns the named tokens from the subject. If the subject doesn't
+// match the pattern nothing is returned.
+func (m *SubjectMapping) Extract(subject string) map[string]string {
+	parts := strings.Split(subject, ".")
+	fields := make(map[string]string)
+	for i, t := range m.tokens {
+		if t == ">" {
+			if i >= len(parts) {
+				return nil
+			}
+			return fields
+		}
+		if i >= len(parts) {
+			return nil
+		}
+
+		switch {
+		case t == "*":
+		case strings.HasPrefix(t, "{"):
+			fields[t[1:len(t)-1]] = parts[i]
+		case t != parts[i]:
+			return nil
+		}
+	}
+
+	if len(parts) != len(m.tokens) {
+		return nil
+	}
+
+	return fields
+}
+
+// Apply will set the named tokens from the subject on the payload
+func (m *SubjectMapping) Apply(subject string, p Payload) {
+	for k, v := range m.Extract(subject) {
+		p[k] = v
+	}
+}
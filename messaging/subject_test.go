@@ -0,0 +1,41 @@
+package messaging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubjectMapping(t *testing.T) {
+	m, err := NewSubjectMapping("logs.{env}.{service}.*")
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]string{"env": "prod", "service": "api"}, m.Extract("logs.prod.api.host1"))
+	assert.Nil(t, m.Extract("logs.prod.api"))
+	assert.Nil(t, m.Extract("logs.prod.api.host1.extra"))
+	assert.Nil(t, m.Extract("metrics.prod.api.host1"))
+}
+
+func TestSubjectMappingWithTail(t *testing.T) {
+	m, err := NewSubjectMapping("logs.{env}.>")
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]string{"env": "prod"}, m.Extract("logs.prod.api.host1"))
+	assert.Nil(t, m.Extract("logs.prod"))
+}
+
+func TestSubjectMappingApply(t *testing.T) {
+	m, err := NewSubjectMapping("logs.{env}")
+	assert.Nil(t, err)
+
+	p := Payload{"msg": "hello"}
+	m.Apply("logs.prod", p)
+	assert.Equal(t, Payload{"msg": "hello", "env": "prod"}, p)
+}
+
+func TestBadSubjectMappings(t *testing.T) {
+	for _, pattern := range []string{"logs..{env}", "logs.>.{env}", "logs.{env", "logs.{}"} {
+		_, err := NewSubjectMapping(pattern)
+		assert.NotNil(t, err, pattern)
+	}
+}
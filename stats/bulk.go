@@ -0,0 +1,104 @@
+package stats
+
+import (
+	"sort"
+	"time"
+)
+
+// hostHistograms are the histograms of the bulk requests sent to one host
+type hostHistograms struct {
+	latency *Histogram
+	bytes   *Histogram
+	docs    *Histogram
+	lag     *Histogram
+}
+
+// HostStats summarizes the bulk requests sent to one host of an endpoint
+type HostStats struct {
+	Bulks      uint64    `json:"bulks"`
+	LatencySec Quantiles `json:"latency_sec"`
+	Bytes      Quantiles `json:"bytes"`
+	Docs       Quantiles `json:"docs"`
+	LagSec     Quantiles `json:"lag_sec"`
+}
+
+// host returns the histograms of the host, creating them with its first request
+func (c *Counters) host(host string) *hostHistograms {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hosts == nil {
+		c.hosts = make(map[string]*hostHistograms)
+	}
+	h, ok := c.hosts[host]
+	if !ok {
+		h = &hostHistograms{
+			latency: NewHistogram(LatencyBuckets),
+			bytes:   NewHistogram(BytesBuckets),
+			docs:    NewHistogram(DocsBuckets),
+			lag:     NewHistogram(LagBuckets),
+		}
+		c.hosts[host] = h
+	}
+	return h
+}
+
+// ObserveBulk records how long a bulk request to the host took, how big its
+// body was and how many documents it had
+func (c *Counters) ObserveBulk(host string, elapsed time.Duration, bytes, docs int) {
+	h := c.host(host)
+	h.latency.Observe(elapsed.Seconds())
+	h.bytes.Observe(float64(bytes))
+	h.docs.Observe(float64(docs))
+}
+
+// ObserveLag records how long it took from receiving the messages until the
+// host indexed them
+func (c *Counters) ObserveLag(host string, lags ...time.Duration) {
+	h := c.host(host)
+	for _, lag := range lags {
+		h.lag.Observe(lag.Seconds())
+	}
+}
+
+// HostStats returns the p50, p95 and p99 of the bulk requests by host
+func (c *Counters) HostStats() map[string]HostStats {
+	summaries := make(map[string]HostStats)
+	for host, h := range c.hostHistograms() {
+		summaries[host] = HostStats{
+			Bulks:      h.latency.Count(),
+			LatencySec: h.latency.Quantiles(),
+			Bytes:      h.bytes.Quantiles(),
+			Docs:       h.docs.Quantiles(),
+			LagSec:     h.lag.Quantiles(),
+		}
+	}
+	return summaries
+}
+
+func (c *Counters) hostHistograms() map[string]*hostHistograms {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	copied := make(map[string]*hostHistograms, len(c.hosts))
+	for host, h := range c.hosts {
+		copied[host] = h
+	}
+	return copied
+}
+
+// collectHosts adds the histograms of every host, in a stable order
+func (c *Counters) collectHosts(e *Exposition, labels Labels) {
+	hosts := c.hostHistograms()
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	for _, host := range names {
+		h, hostLabels := hosts[host], labels.with("host", host)
+		e.Histogram("elastinats_endpoint_bulk_duration_seconds", "How long the bulk requests took", hostLabels, h.latency)
+		e.Histogram("elastinats_endpoint_bulk_bytes", "The size of the bodies of the bulk requests", hostLabels, h.bytes)
+		e.Histogram("elastinats_endpoint_bulk_documents", "The number of documents in the bulk requests", hostLabels, h.docs)
+		e.Histogram("elastinats_endpoint_lag_seconds", "How long it took from receiving a message until it was indexed", hostLabels, h.lag)
+	}
+}
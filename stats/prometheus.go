@@ -0,0 +1,207 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the buckets of the bulk request histograms
+var (
+	LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	DocsBuckets    = []float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000}
+	BytesBuckets   = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+	LagBuckets     = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+)
+
+// Histogram counts observations in buckets like a Prometheus histogram
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// NewHistogram creates a histogram with the upper bounds of the buckets, the
+// +Inf bucket is added
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// Count is the number of observations
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// Quantile estimates the value below which the q fraction of the observations
+// fall, interpolating within the bucket like Prometheus' histogram_quantile.
+// It is 0 without observations and the largest bound if it falls in +Inf.
+func (h *Histogram) Quantile(q float64) float64 {
+	counts, total, _ := h.cumulative()
+	if total == 0 || len(h.buckets) == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	for i, upper := range h.buckets {
+		if float64(counts[i]) < rank {
+			continue
+		}
+		lower, below := 0.0, uint64(0)
+		if i > 0 {
+			lower, below = h.buckets[i-1], counts[i-1]
+		}
+		if counts[i] == below {
+			return lower
+		}
+		return lower + (upper-lower)*(rank-float64(below))/float64(counts[i]-below)
+	}
+	return h.buckets[len(h.buckets)-1]
+}
+
+// Quantiles are the p50, p95 and p99 of a histogram
+type Quantiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+func (h *Histogram) Quantiles() Quantiles {
+	return Quantiles{
+		P50: h.Quantile(0.5),
+		P95: h.Quantile(0.95),
+		P99: h.Quantile(0.99),
+	}
+}
+
+// cumulative returns the number of observations up to each bucket, the total
+// count and the sum
+func (h *Histogram) cumulative() ([]uint64, uint64, float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make([]uint64, len(h.counts))
+	var total uint64
+	for i, c := range h.counts {
+		total += c
+		counts[i] = total
+	}
+	return counts, h.count, h.sum
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Labels are the labels of a metric
+type Labels map[string]string
+
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, k, labelEscaper.Replace(l[k]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (l Labels) with(key, value string) Labels {
+	copied := Labels{key: value}
+	for k, v := range l {
+		copied[k] = v
+	}
+	return copied
+}
+
+// Exposition collects metrics and writes them in the Prometheus text format
+type Exposition struct {
+	families map[string]*family
+	order    []string
+}
+
+type family struct {
+	help    string
+	kind    string
+	samples []string
+}
+
+func NewExposition() *Exposition {
+	return &Exposition{families: make(map[string]*family)}
+}
+
+func (e *Exposition) Counter(name, help string, labels Labels, value int64) {
+	e.add(name, help, "counter", fmt.Sprintf("%s%s %d", name, labels, value))
+}
+
+func (e *Exposition) Gauge(name, help string, labels Labels, value int64) {
+	e.add(name, help, "gauge", fmt.Sprintf("%s%s %d", name, labels, value))
+}
+
+func (e *Exposition) Histogram(name, help string, labels Labels, h *Histogram) {
+	counts, count, sum := h.cumulative()
+	for i, bound := range h.buckets {
+		e.add(name, help, "histogram", fmt.Sprintf("%s_bucket%s %d", name, labels.with("le", formatFloat(bound)), counts[i]))
+	}
+	e.add(name, help, "histogram", fmt.Sprintf("%s_bucket%s %d", name, labels.with("le", "+Inf"), count))
+	e.add(name, help, "histogram", fmt.Sprintf("%s_sum%s %s", name, labels, formatFloat(sum)))
+	e.add(name, help, "histogram", fmt.Sprintf("%s_count%s %d", name, labels, count))
+}
+
+func (e *Exposition) add(name, help, kind, sample string) {
+	f, ok := e.families[name]
+	if !ok {
+		f = &family{help: help, kind: kind}
+		e.families[name] = f
+		e.order = append(e.order, name)
+	}
+	f.samples = append(f.samples, sample)
+}
+
+// WriteTo writes the metrics grouped by name in the order they were first added
+func (e *Exposition) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, name := range e.order {
+		f := e.families[name]
+		n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s\n", name, f.help, name, f.kind, strings.Join(f.samples, "\n"))
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
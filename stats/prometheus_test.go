@@ -0,0 +1,92 @@
+package stats
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSubscription struct{}
+
+func (fakeSubscription) Pending() (int, int, error) { return 3, 300, nil }
+func (fakeSubscription) Delivered() (int64, error)  { return 42, nil }
+func (fakeSubscription) Dropped() (int, error)      { return 1, nil }
+
+func TestExposition(t *testing.T) {
+	endpoint := new(Counters)
+	endpoint.IncrementBatchesSent()
+	endpoint.IncrementMessagesSent(2)
+	endpoint.IncrementErrors("mapper_parsing_exception", 1)
+	endpoint.ObserveBulk("es1", 30*time.Millisecond, 2048, 2)
+	endpoint.ObserveLag("es1", 2*time.Second)
+
+	subject := NewSubjectCounter("logs.>", "shared")
+	subject.IncrementMessagesConsumed()
+
+	e := NewExposition()
+	endpoint.Collect(e, Labels{"index": "logs"})
+	subject.Collect(e, Labels{"subject": "logs.>", "group": "shared", "index": "logs"}, fakeSubscription{})
+
+	out := new(bytes.Buffer)
+	_, err := e.WriteTo(out)
+	assert.Nil(t, err)
+
+	expected := []string{
+		"# TYPE elastinats_endpoint_batches_sent_total counter\nelastinats_endpoint_batches_sent_total{index=\"logs\"} 1\n",
+		"elastinats_endpoint_messages_sent_total{index=\"logs\"} 2\n",
+		"elastinats_endpoint_errors_total{index=\"logs\",type=\"mapper_parsing_exception\"} 1\n",
+		"# TYPE elastinats_endpoint_bulk_duration_seconds histogram\n",
+		"elastinats_endpoint_bulk_duration_seconds_bucket{host=\"es1\",index=\"logs\",le=\"0.025\"} 0\n",
+		"elastinats_endpoint_bulk_duration_seconds_bucket{host=\"es1\",index=\"logs\",le=\"0.05\"} 1\n",
+		"elastinats_endpoint_bulk_duration_seconds_bucket{host=\"es1\",index=\"logs\",le=\"+Inf\"} 1\n",
+		"elastinats_endpoint_bulk_bytes_sum{host=\"es1\",index=\"logs\"} 2048\n",
+		"elastinats_endpoint_bulk_documents_sum{host=\"es1\",index=\"logs\"} 2\n",
+		"elastinats_endpoint_bulk_documents_count{host=\"es1\",index=\"logs\"} 1\n",
+		"elastinats_endpoint_lag_seconds_bucket{host=\"es1\",index=\"logs\",le=\"2.5\"} 1\n",
+		"elastinats_subject_messages_consumed_total{group=\"shared\",index=\"logs\",subject=\"logs.>\"} 1\n",
+		"elastinats_subscription_pending_messages{group=\"shared\",index=\"logs\",subject=\"logs.>\"} 3\n",
+		"elastinats_subscription_delivered_messages{group=\"shared\",index=\"logs\",subject=\"logs.>\"} 42\n",
+	}
+	for _, line := range expected {
+		assert.Contains(t, out.String(), line)
+	}
+}
+
+func TestQuantiles(t *testing.T) {
+	h := NewHistogram([]float64{1, 2, 4})
+	assert.Equal(t, Quantiles{}, h.Quantiles())
+
+	for _, v := range []float64{0.5, 1.5, 1.5, 3} {
+		h.Observe(v)
+	}
+	assert.Equal(t, 1.0, h.Quantile(0.25))
+	assert.Equal(t, 1.5, h.Quantile(0.5))
+	assert.InDelta(t, 3.6, h.Quantile(0.95), 0.0001)
+
+	// above the largest bound there is nothing to interpolate towards
+	h.Observe(100)
+	h.Observe(100)
+	assert.Equal(t, 4.0, h.Quantile(0.99))
+}
+
+func TestHostStats(t *testing.T) {
+	endpoint := new(Counters)
+	endpoint.ObserveBulk("es1", 20*time.Millisecond, 1000, 10)
+	endpoint.ObserveBulk("es2", 3*time.Second, 1000, 10)
+	endpoint.ObserveLag("es2", 3*time.Second, 4*time.Second)
+
+	hosts := endpoint.HostStats()
+	assert.Len(t, hosts, 2)
+	assert.EqualValues(t, 1, hosts["es1"].Bulks)
+	assert.True(t, hosts["es1"].LatencySec.P99 <= 0.025)
+	assert.True(t, hosts["es2"].LatencySec.P50 > 2.5)
+	assert.Equal(t, Quantiles{}, hosts["es1"].LagSec)
+	assert.True(t, hosts["es2"].LagSec.P50 > 2.5 && hosts["es2"].LagSec.P50 <= 5)
+}
+
+func TestLabelsAreEscaped(t *testing.T) {
+	assert.Equal(t, `{a="x\"y",b="1\n2"}`, Labels{"b": "1\n2", "a": `x"y`}.String())
+	assert.Equal(t, "", Labels{}.String())
+}
@@ -1,14 +1,14 @@
 package stats
 
 import (
-	"runtime"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 
 	"sync/atomic"
 
-	"github.com/nats-io/nats"
 	"github.com/netlify/elastinats/conf"
 )
 
@@ -21,6 +21,17 @@ type Counters struct {
 	Index        string
 	BatchSize    int
 	BatchTimeout int
+
+	// when the last bulk request was sent and when one last succeeded, in unix nanoseconds
+	lastBulk    int64
+	lastSuccess int64
+
+	// the histograms of the bulk requests by host, created with the first
+	// request to the host. The mutex also guards the batch size and timeout,
+	// which can be changed while running.
+	mu     sync.Mutex
+	hosts  map[string]*hostHistograms
+	errors map[string]int64
 }
 
 func NewCounter(el *conf.ElasticConfig) *Counters {
@@ -35,8 +46,29 @@ func (c *Counters) IncrementMessagesConsumed() int64 {
 	return atomic.AddInt64(&c.MessagsConsumed, 1)
 }
 
+// IncrementBatchesSent counts a bulk request and when it was sent
 func (c *Counters) IncrementBatchesSent() {
 	atomic.AddInt64(&c.BatchesSent, 1)
+	atomic.StoreInt64(&c.lastBulk, time.Now().UnixNano())
+}
+
+// BulkSucceeded records that elasticsearch accepted a bulk request, some of its
+// documents might still have failed
+func (c *Counters) BulkSucceeded() {
+	atomic.StoreInt64(&c.lastSuccess, time.Now().UnixNano())
+}
+
+// LastBulk returns when the last bulk request was sent and when one last
+// succeeded, they're zero if there wasn't one
+func (c *Counters) LastBulk() (time.Time, time.Time) {
+	return unixNano(atomic.LoadInt64(&c.lastBulk)), unixNano(atomic.LoadInt64(&c.lastSuccess))
+}
+
+func unixNano(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
 }
 
 func (c *Counters) IncrementBatchesFailed() {
@@ -47,69 +79,102 @@ func (c *Counters) IncrementMessagesSent(val int64) {
 	atomic.AddInt64(&c.MessagesSent, val)
 }
 
-func (c *Counters) StartReporting(reportSec int64, nc *nats.Conn, sub *nats.Subscription, log *logrus.Entry) {
+// IncrementErrors counts the documents that failed with the type of error
+func (c *Counters) IncrementErrors(errType string, count int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.errors == nil {
+		c.errors = make(map[string]int64)
+	}
+	c.errors[errType] += count
+}
+
+// Errors returns the number of failed documents by the type of error
+func (c *Counters) Errors() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	errs := make(map[string]int64, len(c.errors))
+	for t, count := range c.errors {
+		errs[t] = count
+	}
+	return errs
+}
+
+// Collect adds the counters of the endpoint to the metrics
+func (c *Counters) Collect(e *Exposition, labels Labels) {
+	e.Counter("elastinats_endpoint_messages_consumed_total", "Messages taken off the buffer of the endpoint", labels, atomic.LoadInt64(&c.MessagsConsumed))
+	e.Counter("elastinats_endpoint_messages_sent_total", "Messages sent to elasticsearch", labels, atomic.LoadInt64(&c.MessagesSent))
+	e.Counter("elastinats_endpoint_batches_sent_total", "Bulk requests sent to elasticsearch", labels, atomic.LoadInt64(&c.BatchesSent))
+	e.Counter("elastinats_endpoint_batches_failed_total", "Bulk requests that failed or had failed documents", labels, atomic.LoadInt64(&c.BatchesFailed))
+
+	errs := c.Errors()
+	types := make([]string, 0, len(errs))
+	for t := range errs {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		e.Counter("elastinats_endpoint_errors_total", "Documents that failed to be indexed by the type of error", labels.with("type", t), errs[t])
+	}
+
+	c.collectHosts(e, labels)
+}
+
+// SetBatching records that the batch size and timeout were changed
+func (c *Counters) SetBatching(size, timeoutSec int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.BatchSize = size
+	c.BatchTimeout = timeoutSec
+}
+
+// Batching returns the current batch size and timeout
+func (c *Counters) Batching() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.BatchSize, c.BatchTimeout
+}
+
+// StartReporting will periodically log the counters of the endpoint until the
+// returned channel is closed
+func (c *Counters) StartReporting(reportSec int64, log *logrus.Entry) chan<- bool {
+	return every(reportSec, log, func() {
+		batchSize, batchTimeout := c.Batching()
+		log.WithFields(logrus.Fields{
+			"messages_rx":    atomic.LoadInt64(&c.MessagsConsumed),
+			"messages_tx":    atomic.LoadInt64(&c.MessagesSent),
+			"batches_tx":     atomic.LoadInt64(&c.BatchesSent),
+			"batches_failed": atomic.LoadInt64(&c.BatchesFailed),
+			"batch_size":     batchSize,
+			"batch_timeout":  batchTimeout,
+			"index":          c.Index,
+			"host_stats":     c.HostStats(),
+		}).Info("endpoint status report")
+	})
+}
+
+func every(reportSec int64, log *logrus.Entry, report func()) chan<- bool {
+	shutdown := make(chan bool)
 	if reportSec == 0 {
 		log.Debug("Stats reporting disabled")
-		return
+		return shutdown
 	}
 
 	dur := time.Duration(reportSec) * time.Second
 
 	go func() {
-		ticks := time.Tick(dur)
+		ticks := time.NewTicker(dur)
+		defer ticks.Stop()
 		log.Debugf("Starting to report stats every %s", dur.String())
-		for range ticks {
-			reportStats(c, nc, sub, log)
+		for {
+			select {
+			case <-ticks.C:
+				report()
+			case <-shutdown:
+				return
+			}
 		}
 	}()
-}
-
-func reportStats(c *Counters, nc *nats.Conn, sub *nats.Subscription, log *logrus.Entry) {
-	memstats := new(runtime.MemStats)
-	runtime.ReadMemStats(memstats)
-
-	pendingMsgs, pendingBytes, err := sub.Pending()
-	if err != nil {
-		log.WithError(err).Warn("Failed to get pending information")
-	}
-
-	deliveredMsgs, err := sub.Delivered()
-	if err != nil {
-		log.WithError(err).Warn("Failed to get delivered msgs")
-	}
-
-	droppedMsgs, err := sub.Dropped()
-	if err != nil {
-		log.WithError(err).Warn("Failed to get dropped msgs")
-	}
 
-	log.WithFields(logrus.Fields{
-		"pending_msgs":   pendingMsgs,
-		"pending_bytes":  pendingBytes,
-		"delivered_msgs": deliveredMsgs,
-		"dropped_msgs":   droppedMsgs,
-
-		"go_routines":   runtime.NumGoroutine(),
-		"total_alloc":   memstats.TotalAlloc,
-		"current_alloc": memstats.Alloc,
-		"mem_sys":       memstats.Sys,
-		"mallocs":       memstats.Mallocs,
-		"frees":         memstats.Frees,
-		"heap_in_use":   memstats.HeapInuse,
-		"heap_idle":     memstats.HeapIdle,
-		"heap_sys":      memstats.HeapSys,
-		"heap_released": memstats.HeapReleased,
-
-		"messages_rx_nc": nc.InMsgs,
-		"messages_tx_nc": nc.OutMsgs,
-		"bytes_rx_nc":    nc.InBytes,
-		"bytes_tx_nc":    nc.OutBytes,
-
-		"messages_rx":    c.MessagsConsumed,
-		"messages_tx":    c.MessagesSent,
-		"batches_tx":     c.BatchesSent,
-		"batches_failed": c.BatchesFailed,
-		"batch_size":     c.BatchSize,
-		"batch_timeout":  c.BatchTimeout,
-	}).Info("status report")
+	return shutdown
 }
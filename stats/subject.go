@@ -0,0 +1,275 @@
+package stats
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nats-io/nats.go"
+
+	"github.com/netlify/elastinats/messaging"
+)
+
+// SubjectCounters tracks what happened to the messages of a single subscription,
+// the endpoint it sends to is tracked by Counters
+type SubjectCounters struct {
+	Subject string `json:"subject"`
+	Group   string `json:"group"`
+
+	MessagesConsumed int64 `json:"messages_rx"`
+	MessagesParsed   int64 `json:"messages_parsed"`
+	MessagesSent     int64 `json:"messages_tx"`
+	MessagesFailed   int64 `json:"messages_failed"`
+
+	PayloadsFlattened    int64 `json:"payloads_flattened"`
+	PayloadsDepthLimited int64 `json:"payloads_depth_limited"`
+	PayloadsKeyLimited   int64 `json:"payloads_key_limited"`
+
+	MessagesAcked      int64 `json:"messages_acked"`
+	MessagesNaked      int64 `json:"messages_naked"`
+	MessagesTerminated int64 `json:"messages_terminated"`
+
+	SlowConsumers   int64 `json:"slow_consumers"`
+	MessagesDropped int64 `json:"messages_dropped"`
+	Pauses          int64 `json:"pauses"`
+	DecodeErrors    int64 `json:"decode_errors"`
+	RepliesSent     int64 `json:"replies_sent"`
+}
+
+// ConnCounters tracks the lifecycle events of a nats connection
+type ConnCounters struct {
+	Disconnects       int64
+	Reconnects        int64
+	ServersDiscovered int64
+}
+
+func (c *ConnCounters) IncrementDisconnects() {
+	atomic.AddInt64(&c.Disconnects, 1)
+}
+
+func (c *ConnCounters) IncrementReconnects() {
+	atomic.AddInt64(&c.Reconnects, 1)
+}
+
+func (c *ConnCounters) IncrementServersDiscovered() {
+	atomic.AddInt64(&c.ServersDiscovered, 1)
+}
+
+// Subscription is what is reported about a nats subscription
+type Subscription interface {
+	Pending() (int, int, error)
+	Delivered() (int64, error)
+	Dropped() (int, error)
+}
+
+func NewSubjectCounter(subject, group string) *SubjectCounters {
+	return &SubjectCounters{
+		Subject: subject,
+		Group:   group,
+	}
+}
+
+func (c *SubjectCounters) IncrementMessagesConsumed() {
+	atomic.AddInt64(&c.MessagesConsumed, 1)
+}
+
+func (c *SubjectCounters) IncrementMessagesParsed() {
+	atomic.AddInt64(&c.MessagesParsed, 1)
+}
+
+// IncrementResult counts whether the message made it into elasticsearch
+func (c *SubjectCounters) IncrementResult(res messaging.IndexResult) {
+	if res.Err == nil {
+		atomic.AddInt64(&c.MessagesSent, 1)
+	} else {
+		atomic.AddInt64(&c.MessagesFailed, 1)
+	}
+}
+
+// IncrementPayloadLimits will count each of the payload limits that were hit
+func (c *SubjectCounters) IncrementPayloadLimits(limits messaging.Limits) {
+	if limits.Flattened {
+		atomic.AddInt64(&c.PayloadsFlattened, 1)
+	}
+	if limits.DepthLimited {
+		atomic.AddInt64(&c.PayloadsDepthLimited, 1)
+	}
+	if limits.KeyLimited {
+		atomic.AddInt64(&c.PayloadsKeyLimited, 1)
+	}
+}
+
+// IncrementSettled counts how a JetStream message was settled
+func (c *SubjectCounters) IncrementSettled(action string) {
+	switch action {
+	case messaging.Acked:
+		atomic.AddInt64(&c.MessagesAcked, 1)
+	case messaging.Naked:
+		atomic.AddInt64(&c.MessagesNaked, 1)
+	case messaging.Terminated:
+		atomic.AddInt64(&c.MessagesTerminated, 1)
+	}
+}
+
+func (c *SubjectCounters) IncrementSlowConsumers() {
+	atomic.AddInt64(&c.SlowConsumers, 1)
+}
+
+// AddMessagesDropped counts the messages that the nats client dropped because
+// the pending limits were hit
+func (c *SubjectCounters) AddMessagesDropped(count int64) {
+	atomic.AddInt64(&c.MessagesDropped, count)
+}
+
+func (c *SubjectCounters) IncrementPauses() {
+	atomic.AddInt64(&c.Pauses, 1)
+}
+
+func (c *SubjectCounters) IncrementDecodeErrors() {
+	atomic.AddInt64(&c.DecodeErrors, 1)
+}
+
+func (c *SubjectCounters) IncrementRepliesSent() {
+	atomic.AddInt64(&c.RepliesSent, 1)
+}
+
+// Snapshot returns a copy of the counters that is safe to read while they're updated
+func (c *SubjectCounters) Snapshot() *SubjectCounters {
+	return &SubjectCounters{
+		Subject:              c.Subject,
+		Group:                c.Group,
+		MessagesConsumed:     atomic.LoadInt64(&c.MessagesConsumed),
+		MessagesParsed:       atomic.LoadInt64(&c.MessagesParsed),
+		MessagesSent:         atomic.LoadInt64(&c.MessagesSent),
+		MessagesFailed:       atomic.LoadInt64(&c.MessagesFailed),
+		PayloadsFlattened:    atomic.LoadInt64(&c.PayloadsFlattened),
+		PayloadsDepthLimited: atomic.LoadInt64(&c.PayloadsDepthLimited),
+		PayloadsKeyLimited:   atomic.LoadInt64(&c.PayloadsKeyLimited),
+		MessagesAcked:        atomic.LoadInt64(&c.MessagesAcked),
+		MessagesNaked:        atomic.LoadInt64(&c.MessagesNaked),
+		MessagesTerminated:   atomic.LoadInt64(&c.MessagesTerminated),
+		SlowConsumers:        atomic.LoadInt64(&c.SlowConsumers),
+		MessagesDropped:      atomic.LoadInt64(&c.MessagesDropped),
+		Pauses:               atomic.LoadInt64(&c.Pauses),
+		DecodeErrors:         atomic.LoadInt64(&c.DecodeErrors),
+		RepliesSent:          atomic.LoadInt64(&c.RepliesSent),
+	}
+}
+
+// Collect adds the counters of the subscription and the state of the nats
+// subscription to the metrics
+func (c *SubjectCounters) Collect(e *Exposition, labels Labels, sub Subscription) {
+	counters := []struct {
+		name  string
+		help  string
+		value *int64
+	}{
+		{"messages_consumed", "Messages received from nats", &c.MessagesConsumed},
+		{"messages_parsed", "Messages whose payload was JSON", &c.MessagesParsed},
+		{"messages_sent", "Messages that were indexed", &c.MessagesSent},
+		{"messages_failed", "Messages that failed to be indexed", &c.MessagesFailed},
+		{"payloads_flattened", "Payloads that were flattened", &c.PayloadsFlattened},
+		{"payloads_depth_limited", "Payloads that were nested too deep", &c.PayloadsDepthLimited},
+		{"payloads_key_limited", "Payloads that had too many keys", &c.PayloadsKeyLimited},
+		{"messages_acked", "JetStream messages that were acked", &c.MessagesAcked},
+		{"messages_naked", "JetStream messages that were nak'ed", &c.MessagesNaked},
+		{"messages_terminated", "JetStream messages that were terminated", &c.MessagesTerminated},
+		{"slow_consumers", "Times the pending limits were hit", &c.SlowConsumers},
+		{"messages_dropped", "Messages the nats client dropped because of the pending limits", &c.MessagesDropped},
+		{"pauses", "Times the subscription was paused", &c.Pauses},
+		{"decode_errors", "Messages whose payload couldn't be decoded", &c.DecodeErrors},
+		{"replies_sent", "Replies sent for indexed messages", &c.RepliesSent},
+	}
+	for _, counter := range counters {
+		e.Counter("elastinats_subject_"+counter.name+"_total", counter.help, labels, atomic.LoadInt64(counter.value))
+	}
+
+	// the errors are only from when the subscription was just closed
+	pendingMsgs, pendingBytes, _ := sub.Pending()
+	delivered, _ := sub.Delivered()
+	dropped, _ := sub.Dropped()
+	e.Gauge("elastinats_subscription_pending_messages", "Messages the nats client is holding for the subscription", labels, int64(pendingMsgs))
+	e.Gauge("elastinats_subscription_pending_bytes", "Bytes the nats client is holding for the subscription", labels, int64(pendingBytes))
+	e.Gauge("elastinats_subscription_delivered_messages", "Messages delivered to the current nats subscription", labels, delivered)
+	e.Gauge("elastinats_subscription_dropped_messages", "Messages the current nats subscription dropped because of the pending limits", labels, int64(dropped))
+}
+
+// StartReporting will periodically log the counters of the subscription together
+// with the state of the nats subscription and connection, until the returned
+// channel is closed
+func (c *SubjectCounters) StartReporting(reportSec int64, nc *nats.Conn, conn *ConnCounters, sub Subscription, log *logrus.Entry) chan<- bool {
+	return every(reportSec, log, func() {
+		reportStats(c, nc, conn, sub, log)
+	})
+}
+
+func reportStats(c *SubjectCounters, nc *nats.Conn, conn *ConnCounters, sub Subscription, log *logrus.Entry) {
+	memstats := new(runtime.MemStats)
+	runtime.ReadMemStats(memstats)
+
+	pendingMsgs, pendingBytes, err := sub.Pending()
+	if err != nil {
+		log.WithError(err).Warn("Failed to get pending information")
+	}
+
+	deliveredMsgs, err := sub.Delivered()
+	if err != nil {
+		log.WithError(err).Warn("Failed to get delivered msgs")
+	}
+
+	droppedMsgs, err := sub.Dropped()
+	if err != nil {
+		log.WithError(err).Warn("Failed to get dropped msgs")
+	}
+
+	// the connection is shared, so its counters are read under its lock
+	ncStats := nc.Stats()
+	c = c.Snapshot()
+
+	log.WithFields(logrus.Fields{
+		"pending_msgs":   pendingMsgs,
+		"pending_bytes":  pendingBytes,
+		"delivered_msgs": deliveredMsgs,
+		"dropped_msgs":   droppedMsgs,
+
+		"go_routines":   runtime.NumGoroutine(),
+		"total_alloc":   memstats.TotalAlloc,
+		"current_alloc": memstats.Alloc,
+		"mem_sys":       memstats.Sys,
+		"mallocs":       memstats.Mallocs,
+		"frees":         memstats.Frees,
+		"heap_in_use":   memstats.HeapInuse,
+		"heap_idle":     memstats.HeapIdle,
+		"heap_sys":      memstats.HeapSys,
+		"heap_released": memstats.HeapReleased,
+
+		"messages_rx_nc": ncStats.InMsgs,
+		"messages_tx_nc": ncStats.OutMsgs,
+		"bytes_rx_nc":    ncStats.InBytes,
+		"bytes_tx_nc":    ncStats.OutBytes,
+
+		"disconnects_nc":        atomic.LoadInt64(&conn.Disconnects),
+		"reconnects_nc":         atomic.LoadInt64(&conn.Reconnects),
+		"servers_discovered_nc": atomic.LoadInt64(&conn.ServersDiscovered),
+		"status_nc":             nc.Status().String(),
+
+		"messages_rx":     c.MessagesConsumed,
+		"messages_parsed": c.MessagesParsed,
+		"messages_tx":     c.MessagesSent,
+		"messages_failed": c.MessagesFailed,
+
+		"payloads_flattened":     c.PayloadsFlattened,
+		"payloads_depth_limited": c.PayloadsDepthLimited,
+		"payloads_key_limited":   c.PayloadsKeyLimited,
+
+		"messages_acked":      c.MessagesAcked,
+		"messages_naked":      c.MessagesNaked,
+		"messages_terminated": c.MessagesTerminated,
+
+		"slow_consumers":   c.SlowConsumers,
+		"messages_dropped": c.MessagesDropped,
+		"pauses":           c.Pauses,
+		"decode_errors":    c.DecodeErrors,
+		"replies_sent":     c.RepliesSent,
+	}).Info("subject status report")
+}
@@ -0,0 +1,50 @@
+// Package watch notices when files change so that they can be reloaded
+package watch
+
+import (
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const defaultReloadSec = 30
+
+// File polls the file and calls reload when its size or modification time
+// changes. A version that fails to reload isn't tried again, only the next
+// change is. It keeps going until shutdown is closed.
+func File(path string, reloadSec int, reload func() error, log *logrus.Entry, shutdown <-chan bool) {
+	if reloadSec <= 0 {
+		reloadSec = defaultReloadSec
+	}
+
+	last, err := os.Stat(path)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to stat %s", path)
+	}
+
+	ticks := time.NewTicker(time.Duration(reloadSec) * time.Second)
+	defer ticks.Stop()
+	for {
+		select {
+		case <-ticks.C:
+			current, err := os.Stat(path)
+			if err != nil {
+				log.WithError(err).Warnf("Failed to stat %s", path)
+				continue
+			}
+			if last != nil && current.ModTime().Equal(last.ModTime()) && current.Size() == last.Size() {
+				continue
+			}
+
+			last = current
+			if err := reload(); err != nil {
+				log.WithError(err).Warnf("Failed to reload %s - keeping the previous version", path)
+				continue
+			}
+			log.Infof("Reloaded %s", path)
+		case <-shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package watch
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailedReloadIsNotRetried(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("{}"), 0644))
+
+	var reloads int64
+	shutdown := make(chan bool)
+	defer close(shutdown)
+	go File(path, 1, func() error {
+		atomic.AddInt64(&reloads, 1)
+		return errors.New("broken")
+	}, logrus.WithField("testing", true), shutdown)
+
+	// the first stat is from before the change
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, ioutil.WriteFile(path, []byte("{broken"), 0644))
+	time.Sleep(3500 * time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt64(&reloads))
+}